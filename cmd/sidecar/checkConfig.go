@@ -1,27 +1,88 @@
 package main
 
 import (
-	"os"
+	"context"
+	"path/filepath"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
 )
 
-func checkConfig(filePath string) {
+// checkConfig watches filePath and sends every changed valid config to reloads,
+// the receiver validates its pipelines and counts the reload.
+// The directory is watched, not the file, so the "..data" symlink swap done by
+// kubelet for ConfigMap volumes is noticed too. An invalid config is reported
+// and the current one is kept.
+func checkConfig(ctx context.Context, filePath string, reloads chan<- *config.Config) {
 
 	ohash, err := hashFileMd5(filePath)
 	if err != nil {
-		panic(err)
+		log.Errorf("Check config: %v", err)
 	}
 	log.Infof("Check config started on %s  (hash: %s)", filePath, ohash)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorf("Check config: inotify not available, polling only: %v", err)
+	} else {
+		defer watcher.Close()
+		if err := watcher.Add(filepath.Dir(filePath)); err != nil {
+			log.Errorf("Check config: %v", err)
+		}
+	}
+	var fsEvents <-chan fsnotify.Event
+	var fsErrors <-chan error
+	if watcher != nil {
+		fsEvents = watcher.Events
+		fsErrors = watcher.Errors
+	}
+
+	// events come in bursts (symlink swap, editors), check once they settle
+	settle := time.NewTimer(0)
+	<-settle.C
+	poll := time.NewTicker(5 * time.Minute)
+	defer poll.Stop()
 	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-fsEvents:
+			name := filepath.Base(ev.Name)
+			if name == filepath.Base(filePath) || name == "..data" {
+				log.Debugf("Check config: %s", ev)
+				settle.Reset(time.Second)
+			}
+			continue
+		case err := <-fsErrors:
+			log.Warnf("Check config: %v", err)
+			continue
+		case <-settle.C:
+		case <-poll.C:
+		}
+
 		hash, err := hashFileMd5(filePath)
 		if err != nil {
-			panic(err)
+			log.Errorf("Check config: %v", err)
+			continue
+		}
+		if ohash == hash {
+			continue
+		}
+		log.Info("New Config found")
+		conf, _, err := config.LoadConfigFile(filePath)
+		if err != nil {
+			log.Errorf("New config is invalid, keeping the current one: %s", err)
+			sidecarConfigReloadSuccess.Set(0)
+			sidecarConfigReloadFailures.Inc()
+			ohash = hash
+			continue
 		}
-		if ohash != hash {
-			log.Info("New Config found stop sidecar")
-			os.Exit(0)
+		select {
+		case reloads <- conf:
+		case <-ctx.Done():
+			return
 		}
-		time.Sleep(5 * time.Minute)
-		//time.Sleep(5 * time.Second)
+		ohash = hash
 	}
 }
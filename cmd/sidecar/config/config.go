@@ -3,7 +3,14 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
@@ -60,31 +67,466 @@ func LoadConfigFile(filename string) (*Config, []byte, error) {
 }
 
 // Config is the top-level configuration for JIRAlert's config file.
+// The inlined Pipeline keeps the single pipeline layout working, it is used
+// when Selectors are set at the top level.
 type Config struct {
-	Template               string   `yaml:"Template" json:"Template"`
-	CheckYaml              bool     `yaml:"CheckYaml" json:"CheckYaml"`
-	Selectors              []string `yaml:"Selectors,omitempty" json:"Selectors,omitempty"`
-	CheckSelfConfig        bool     `yaml:"CheckSelfConfig" json:"CheckSelfConfig"`
-	CheckJSON              bool     `yaml:"CheckJSON" json:"CheckJSON"`
-	CheckCommand           string   `yaml:"CheckCommand" json:"CheckCommand"`
-	CheckCommandOKExitCode []int    `yaml:"CheckCommandOKExitCode" json:"CheckCommandOKExitCode"`
-	TmpDirectory           string   `yaml:"TmpDirectory" json:"TmpDirectory"`
-	RemoveComment          bool     `yaml:"RemoveComment" json:"RemoveComment"`
-	RemoveEmptyLines       bool     `yaml:"RemoveEmptyLines" json:"RemoveEmptyLines"`
-	ToFileName             string   `yaml:"ToFileName" json:"ToFileName"`
-	ToDirectory            string   `yaml:"ToDirectory" json:"ToDirectory"`
-	ToNamespace            string   `yaml:"ToNamespace" json:"ToNamespace"`
-	ToSecretName           string   `yaml:"ToSecretName" json:"ToSecretName"`
-	ToConfigMapName        string   `yaml:"ToConfigMapName" json:"ToConfigMapName"`
-	FromNamespace          string   `yaml:"FromNamespace" json:"FromNamespace"`
-	URLRealoads            []string `yaml:"URLRealoads,omitempty" json:"URLRealoads,omitempty"`
-	PrometheusMetricsPort  int      `yaml:"PrometheusMetricsPort" json:"PrometheusMetricsPort"`
-	PrometheusMetricsURL   string   `yaml:"PrometheusMetricsURL" json:"PrometheusMetricsURL"`
+	Pipeline              `yaml:",inline"`
+	Pipelines             []Pipeline `yaml:"Pipelines,omitempty" json:"Pipelines,omitempty"`
+	CheckSelfConfig       bool       `yaml:"CheckSelfConfig" json:"CheckSelfConfig"`
+	PrometheusMetricsPort int        `yaml:"PrometheusMetricsPort" json:"PrometheusMetricsPort"`
+	PrometheusMetricsURL  string     `yaml:"PrometheusMetricsURL" json:"PrometheusMetricsURL"`
+	// ResyncInterval how often all Selectors are listed and compared with the known sources
+	ResyncInterval time.Duration `yaml:"ResyncInterval" json:"ResyncInterval"`
+	// Mode "watch" (default) keeps the outputs up to date, "once" renders all pipelines
+	// once and exits (init container)
+	Mode string `yaml:"Mode,omitempty" json:"Mode,omitempty"`
+	// HealthStuckTimeout /healthz fails when a pipeline did not process its events for this long
+	HealthStuckTimeout time.Duration `yaml:"HealthStuckTimeout,omitempty" json:"HealthStuckTimeout,omitempty"`
+	// HealthStartupTimeout /healthz fails when a pipeline did not finish its initial sync
+	// and first render for this long
+	HealthStartupTimeout time.Duration `yaml:"HealthStartupTimeout,omitempty" json:"HealthStartupTimeout,omitempty"`
+	// HealthWatchDownTimeout /healthz fails when a watch fails for this long
+	HealthWatchDownTimeout time.Duration `yaml:"HealthWatchDownTimeout,omitempty" json:"HealthWatchDownTimeout,omitempty"`
+	// ShutdownGracePeriod how long the validation, write and reload in flight may go on
+	// after SIGTERM, keep it 5s (http server shutdown) below terminationGracePeriodSeconds
+	ShutdownGracePeriod time.Duration `yaml:"ShutdownGracePeriod,omitempty" json:"ShutdownGracePeriod,omitempty"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
 }
 
+// Pipeline is one chain of Selectors -> Template -> validation -> outputs -> reloads.
+// Pipeline is inlined in Config, it must not implement yaml.Unmarshaler.
+type Pipeline struct {
+	Name                   string     `yaml:"Name,omitempty" json:"Name,omitempty"`
+	Template               string     `yaml:"Template" json:"Template"`
+	CheckYaml              bool       `yaml:"CheckYaml" json:"CheckYaml"`
+	Selectors              []Selector `yaml:"Selectors,omitempty" json:"Selectors,omitempty"`
+	CheckJSON              bool       `yaml:"CheckJSON" json:"CheckJSON"`
+	CheckCommand           string     `yaml:"CheckCommand" json:"CheckCommand"`
+	CheckCommandOKExitCode []int      `yaml:"CheckCommandOKExitCode" json:"CheckCommandOKExitCode"`
+	TmpDirectory           string     `yaml:"TmpDirectory" json:"TmpDirectory"`
+	RemoveComment          bool       `yaml:"RemoveComment" json:"RemoveComment"`
+	RemoveEmptyLines       bool       `yaml:"RemoveEmptyLines" json:"RemoveEmptyLines"`
+	ToFileName             string     `yaml:"ToFileName" json:"ToFileName"`
+	ToDirectory            string     `yaml:"ToDirectory" json:"ToDirectory"`
+	ToNamespace            string     `yaml:"ToNamespace" json:"ToNamespace"`
+	ToSecretName           string     `yaml:"ToSecretName" json:"ToSecretName"`
+	ToConfigMapName        string     `yaml:"ToConfigMapName" json:"ToConfigMapName"`
+	FromNamespace          string     `yaml:"FromNamespace" json:"FromNamespace"`
+	// NamespaceSelector, IncludeNamespaces and ExcludeNamespaces (globs) limit the
+	// sources to the matching namespaces of all, the set is watched
+	NamespaceSelector string      `yaml:"NamespaceSelector,omitempty" json:"NamespaceSelector,omitempty"`
+	IncludeNamespaces []string    `yaml:"IncludeNamespaces,omitempty" json:"IncludeNamespaces,omitempty"`
+	ExcludeNamespaces []string    `yaml:"ExcludeNamespaces,omitempty" json:"ExcludeNamespaces,omitempty"`
+	URLRealoads       []URLReload `yaml:"URLRealoads,omitempty" json:"URLRealoads,omitempty"`
+	// SignalReloads send a signal to a process of the pod (shareProcessNamespace: true)
+	SignalReloads []SignalReload `yaml:"SignalReloads,omitempty" json:"SignalReloads,omitempty"`
+	// PreWriteCommands run before the outputs are written, PostWriteCommands after it
+	PreWriteCommands  []Hook `yaml:"PreWriteCommands,omitempty" json:"PreWriteCommands,omitempty"`
+	PostWriteCommands []Hook `yaml:"PostWriteCommands,omitempty" json:"PostWriteCommands,omitempty"`
+	// WriteMode "rename" (default) replaces every file by rename of a temporary file,
+	// "symlink" swaps the whole ToDirectory content at once the way kubelet updates volumes
+	WriteMode string `yaml:"WriteMode,omitempty" json:"WriteMode,omitempty"`
+	// FileMode of the written files (octal, default "0644"), SecretFileMode of the
+	// files with data of Secrets (default FileMode)
+	FileMode       string `yaml:"FileMode,omitempty" json:"FileMode,omitempty"`
+	SecretFileMode string `yaml:"SecretFileMode,omitempty" json:"SecretFileMode,omitempty"`
+	// Decode steps ("base64", "gunzip") applied in order to every data value,
+	// DecodeAnnotation on a source replaces them ("base64,gunzip" or "none")
+	Decode           []string `yaml:"Decode,omitempty" json:"Decode,omitempty"`
+	DecodeAnnotation string   `yaml:"DecodeAnnotation,omitempty" json:"DecodeAnnotation,omitempty"`
+	// TargetDirAnnotation source annotation with a subdirectory of ToDirectory for its files
+	TargetDirAnnotation string `yaml:"TargetDirAnnotation,omitempty" json:"TargetDirAnnotation,omitempty"`
+	// TargetNameAnnotation source annotation with a file name template ({{.key}} is the data key)
+	TargetNameAnnotation string `yaml:"TargetNameAnnotation,omitempty" json:"TargetNameAnnotation,omitempty"`
+	// SortBy order of sources in templates: priority, namespace, name, kind, label:<name>, annotation:<name>
+	SortBy []string `yaml:"SortBy,omitempty" json:"SortBy,omitempty"`
+	// PriorityKey annotation (or label) with the integer priority of the source
+	PriorityKey string `yaml:"PriorityKey,omitempty" json:"PriorityKey,omitempty"`
+	// Merge "yaml" or "json", data keys matching MergeKeys are deep-merged into ToFileName instead of Template
+	Merge string `yaml:"Merge,omitempty" json:"Merge,omitempty"`
+	// MergeKeys glob patterns of data keys to merge, all keys if empty
+	MergeKeys []string `yaml:"MergeKeys,omitempty" json:"MergeKeys,omitempty"`
+	// MergeListStrategy "append" (default) or "replace" lists
+	MergeListStrategy string `yaml:"MergeListStrategy,omitempty" json:"MergeListStrategy,omitempty"`
+	// MergeByKey lists merged by key of their items, e.g. receivers[].name
+	MergeByKey []string `yaml:"MergeByKey,omitempty" json:"MergeByKey,omitempty"`
+	// LastGoodDirectory where the last valid and reloaded output is kept, TmpDirectory
+	// if empty or the k8s-sidecar directory of the system temporary directory
+	LastGoodDirectory string `yaml:"LastGoodDirectory,omitempty" json:"LastGoodDirectory,omitempty"`
+	// ReportEvents emits Kubernetes Events on sources rejected by the validation
+	ReportEvents bool `yaml:"ReportEvents,omitempty" json:"ReportEvents,omitempty"`
+	// ReportStatusAnnotations sets k8s-sidecar/status and k8s-sidecar/last-error annotations on sources
+	ReportStatusAnnotations bool `yaml:"ReportStatusAnnotations,omitempty" json:"ReportStatusAnnotations,omitempty"`
+
+	// DebounceWindow collects events until no new one comes for the window, then renders once (0 renders every event)
+	DebounceWindow time.Duration `yaml:"DebounceWindow,omitempty" json:"DebounceWindow,omitempty"`
+	// DebounceMaxWait renders a batch at the latest this long after its first event
+	DebounceMaxWait time.Duration `yaml:"DebounceMaxWait,omitempty" json:"DebounceMaxWait,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// URLReload is a request telling the consumer to reload its config.
+// A plain string is a GET of the URL.
+type URLReload struct {
+	URL     string            `yaml:"URL" json:"URL"`
+	Method  string            `yaml:"Method,omitempty" json:"Method,omitempty"`
+	Headers map[string]string `yaml:"Headers,omitempty" json:"Headers,omitempty"`
+	Body    string            `yaml:"Body,omitempty" json:"Body,omitempty"`
+	// BasicAuth password or BearerTokenFile are read from files on every request
+	BasicAuth          *BasicAuth    `yaml:"BasicAuth,omitempty" json:"BasicAuth,omitempty"`
+	BearerTokenFile    string        `yaml:"BearerTokenFile,omitempty" json:"BearerTokenFile,omitempty"`
+	CAFile             string        `yaml:"CAFile,omitempty" json:"CAFile,omitempty"`
+	InsecureSkipVerify bool          `yaml:"InsecureSkipVerify,omitempty" json:"InsecureSkipVerify,omitempty"`
+	Timeout            time.Duration `yaml:"Timeout,omitempty" json:"Timeout,omitempty"`
+	// ExpectedStatusCodes are the successful codes, default every code < 400
+	ExpectedStatusCodes []int `yaml:"ExpectedStatusCodes,omitempty" json:"ExpectedStatusCodes,omitempty"`
+	// Retries of a failed request, the wait starts at RetryBackoff and doubles
+	Retries      int           `yaml:"Retries,omitempty" json:"Retries,omitempty"`
+	RetryBackoff time.Duration `yaml:"RetryBackoff,omitempty" json:"RetryBackoff,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// Hook is a command run around the write of the outputs. A plain string is the Command.
+type Hook struct {
+	Command string        `yaml:"Command" json:"Command"`
+	Timeout time.Duration `yaml:"Timeout,omitempty" json:"Timeout,omitempty"`
+	// FailOnError fails the cycle when the command fails: nothing is written after
+	// a failed PreWriteCommands, the last good output is restored after a failed PostWriteCommands
+	FailOnError bool `yaml:"FailOnError,omitempty" json:"FailOnError,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface, a string is the Command.
+func (h *Hook) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var command string
+	if err := unmarshal(&command); err == nil {
+		*h = Hook{Command: command}
+	} else {
+		type plain Hook
+		if err := unmarshal((*plain)(h)); err != nil {
+			return err
+		}
+	}
+	if h.Command == "" {
+		return fmt.Errorf("missing Command in PreWriteCommands/PostWriteCommands")
+	}
+	if h.Timeout == 0 {
+		h.Timeout = 30 * time.Second
+	}
+	if h.Timeout < 0 {
+		return fmt.Errorf("Timeout of %s must be positive", h.Command)
+	}
+	return checkOverflow(h.XXX, "command "+h.Command)
+}
+
+// SignalReload sends Signal (default SIGHUP) to the process named Process
+// or to the process whose pid is in PidFile.
+type SignalReload struct {
+	Process string `yaml:"Process,omitempty" json:"Process,omitempty"`
+	PidFile string `yaml:"PidFile,omitempty" json:"PidFile,omitempty"`
+	Signal  string `yaml:"Signal,omitempty" json:"Signal,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// signals are the names accepted in SignalReload.Signal
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (r *SignalReload) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain SignalReload
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+	if (r.Process == "") == (r.PidFile == "") {
+		return fmt.Errorf("SignalReloads need either Process or PidFile")
+	}
+	if r.Signal == "" {
+		r.Signal = "SIGHUP"
+	}
+	r.Signal = strings.ToUpper(r.Signal)
+	if !strings.HasPrefix(r.Signal, "SIG") {
+		r.Signal = "SIG" + r.Signal
+	}
+	if _, ok := signals[r.Signal]; !ok {
+		return fmt.Errorf("unknown Signal %q in SignalReloads", r.Signal)
+	}
+	return checkOverflow(r.XXX, "SignalReloads "+r.Target())
+}
+
+// SignalNumber returns the signal to send
+func (r SignalReload) SignalNumber() syscall.Signal {
+	return signals[r.Signal]
+}
+
+// Target describes the process of the reload for logs and metrics
+func (r SignalReload) Target() string {
+	if r.PidFile != "" {
+		return "pidfile:" + r.PidFile
+	}
+	return "process:" + r.Process
+}
+
+// BasicAuth of URLReload
+type BasicAuth struct {
+	Username     string `yaml:"Username" json:"Username"`
+	PasswordFile string `yaml:"PasswordFile" json:"PasswordFile"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface, a string is the URL.
+func (r *URLReload) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var url string
+	if err := unmarshal(&url); err == nil {
+		*r = URLReload{URL: url}
+	} else {
+		type plain URLReload
+		if err := unmarshal((*plain)(r)); err != nil {
+			return err
+		}
+	}
+
+	if r.URL == "" {
+		return fmt.Errorf("missing URL in URLRealoads")
+	}
+	if r.Method == "" {
+		r.Method = "GET"
+	}
+	r.Method = strings.ToUpper(r.Method)
+	if r.BasicAuth != nil && r.BearerTokenFile != "" {
+		return fmt.Errorf("URLRealoads %s: BasicAuth and BearerTokenFile are exclusive", r.URL)
+	}
+	if r.BasicAuth != nil && (r.BasicAuth.Username == "" || r.BasicAuth.PasswordFile == "") {
+		return fmt.Errorf("URLRealoads %s: BasicAuth needs Username and PasswordFile", r.URL)
+	}
+	if r.Timeout == 0 {
+		r.Timeout = 10 * time.Second
+	}
+	if r.RetryBackoff == 0 {
+		r.RetryBackoff = time.Second
+	}
+	if r.Timeout < 0 || r.RetryBackoff < 0 || r.Retries < 0 {
+		return fmt.Errorf("URLRealoads %s: Timeout, Retries and RetryBackoff must be positive", r.URL)
+	}
+	return checkOverflow(r.XXX, "URLRealoads "+r.URL)
+}
+
+// Selector selects the sources of a pipeline, Kind is "configmap" or "secret" for
+// the core types, any other Kind is watched through the dynamic client.
+// A Selector is either the string form of ParseSelector or a map with the
+// fields below, the filters of the map form are all ANDed.
+type Selector struct {
+	// APIVersion is group/version of Kind, empty or v1 for the core group
+	APIVersion    string `yaml:"APIVersion,omitempty" json:"APIVersion,omitempty"`
+	Kind          string `yaml:"Kind" json:"Kind"`
+	LabelSelector string `yaml:"LabelSelector,omitempty" json:"LabelSelector,omitempty"`
+	// FieldSelector is given to the API server as well (metadata.name=x)
+	FieldSelector string `yaml:"FieldSelector,omitempty" json:"FieldSelector,omitempty"`
+	// Names are globs (grafana-*), a source must match one of them
+	Names     []string `yaml:"Names,omitempty" json:"Names,omitempty"`
+	NameRegex string   `yaml:"NameRegex,omitempty" json:"NameRegex,omitempty"`
+	// Annotations must all be set on a source, the values are globs ("*" for any value)
+	Annotations map[string]string `yaml:"Annotations,omitempty" json:"Annotations,omitempty"`
+	// IncludeKeys and ExcludeKeys are globs on the data keys (*.json), sources
+	// left without keys are skipped
+	IncludeKeys []string `yaml:"IncludeKeys,omitempty" json:"IncludeKeys,omitempty"`
+	ExcludeKeys []string `yaml:"ExcludeKeys,omitempty" json:"ExcludeKeys,omitempty"`
+
+	Group   string `yaml:"-" json:"-"`
+	Version string `yaml:"-" json:"-"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// Kinds of Selector watched without the dynamic client
+const (
+	KindConfigMap = "configmap"
+	KindSecret    = "secret"
+)
+
+var versionRegexp = regexp.MustCompile(`^v[0-9]+((alpha|beta)[0-9]+)?$`)
+
+// ParseSelector parses the Selectors forms configmap/labelSelector, secret/labelSelector,
+// version/Kind/labelSelector for the core group (v1/Service/app=x) and
+// group/version/Kind/labelSelector (monitoring.coreos.com/v1/PrometheusRule/team=x).
+// The label selector may contain "/" (app.kubernetes.io/name=x) and may be empty.
+func ParseSelector(sel string) (Selector, error) {
+	parts := strings.Split(sel, "/")
+	switch {
+	case len(parts) >= 2 && (parts[0] == KindConfigMap || parts[0] == KindSecret):
+		return Selector{APIVersion: "v1", Version: "v1", Kind: parts[0], LabelSelector: strings.Join(parts[1:], "/")}, nil
+	case len(parts) >= 2 && versionRegexp.MatchString(parts[0]):
+		s := Selector{APIVersion: parts[0], Version: parts[0], Kind: parts[1]}
+		if len(parts) > 2 {
+			s.LabelSelector = strings.Join(parts[2:], "/")
+		}
+		return s, s.check(sel)
+	case len(parts) >= 3 && versionRegexp.MatchString(parts[1]):
+		s := Selector{APIVersion: parts[0] + "/" + parts[1], Group: parts[0], Version: parts[1], Kind: parts[2]}
+		if len(parts) > 3 {
+			s.LabelSelector = strings.Join(parts[3:], "/")
+		}
+		return s, s.check(sel)
+	}
+	return Selector{}, fmt.Errorf("wrong selector %q (configmap/labels, secret/labels or group/version/Kind/labels)", sel)
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface, a string is parsed by ParseSelector.
+func (s *Selector) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var sel string
+	if err := unmarshal(&sel); err == nil {
+		parsed, err := ParseSelector(sel)
+		if err != nil {
+			return err
+		}
+		*s = parsed
+		return nil
+	}
+	type plain Selector
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+
+	switch parts := strings.Split(s.APIVersion, "/"); {
+	case s.APIVersion == "" || s.APIVersion == "v1":
+		s.Version = "v1"
+		if strings.EqualFold(s.Kind, KindConfigMap) || strings.EqualFold(s.Kind, KindSecret) {
+			s.Kind = strings.ToLower(s.Kind)
+		}
+	case len(parts) == 1 && versionRegexp.MatchString(parts[0]):
+		s.Version = parts[0]
+	case len(parts) == 2 && versionRegexp.MatchString(parts[1]):
+		s.Group, s.Version = parts[0], parts[1]
+	default:
+		return fmt.Errorf("wrong APIVersion %q in selector of Kind %s", s.APIVersion, s.Kind)
+	}
+	if s.APIVersion == "" {
+		s.APIVersion = "v1"
+	}
+	if s.Kind == "" {
+		return fmt.Errorf("missing Kind in selector")
+	}
+	if s.Dynamic() {
+		if err := s.check(s.String()); err != nil {
+			return err
+		}
+	}
+	if s.NameRegex != "" {
+		if _, err := regexp.Compile(s.NameRegex); err != nil {
+			return fmt.Errorf("selector %s: wrong NameRegex: %v", s, err)
+		}
+	}
+	var patterns []string
+	patterns = append(patterns, s.Names...)
+	patterns = append(patterns, s.IncludeKeys...)
+	patterns = append(patterns, s.ExcludeKeys...)
+	for _, value := range s.Annotations {
+		patterns = append(patterns, value)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("selector %s: wrong pattern %q: %v", s, pattern, err)
+		}
+	}
+	return checkOverflow(s.XXX, "selector "+s.String())
+}
+
+// String returns the string form of the Kind and LabelSelector of s
+func (s Selector) String() string {
+	if !s.Dynamic() {
+		return s.Kind + "/" + s.LabelSelector
+	}
+	return s.APIVersion + "/" + s.Kind + "/" + s.LabelSelector
+}
+
+func (s Selector) check(sel string) error {
+	if s.Kind == "" {
+		return fmt.Errorf("missing Kind in selector %q", sel)
+	}
+	if s.Group == "" && (strings.EqualFold(s.Kind, "ConfigMap") || strings.EqualFold(s.Kind, "Secret")) {
+		return fmt.Errorf("selector %q: use %s/labels for the core kind", sel, strings.ToLower(s.Kind))
+	}
+	return nil
+}
+
+// Dynamic is true for selectors watched through the dynamic client
+func (s Selector) Dynamic() bool {
+	return s.Kind != KindConfigMap && s.Kind != KindSecret
+}
+
+// Modes of Config.Mode
+const (
+	ModeWatch = "watch"
+	ModeOnce  = "once"
+)
+
+// Write modes of Pipeline.WriteMode
+const (
+	WriteModeRename  = "rename"
+	WriteModeSymlink = "symlink"
+)
+
+// Decode steps of Pipeline.Decode
+const (
+	DecodeBase64 = "base64"
+	DecodeGunzip = "gunzip"
+	DecodeNone   = "none"
+)
+
+// ParseDecode parses the comma separated decode steps of the DecodeAnnotation,
+// "none" is no step
+func ParseDecode(steps string) ([]string, error) {
+	var parsed []string
+	for _, step := range strings.Split(steps, ",") {
+		step = strings.ToLower(strings.TrimSpace(step))
+		switch step {
+		case DecodeBase64, DecodeGunzip:
+			parsed = append(parsed, step)
+		case DecodeNone, "":
+		default:
+			return nil, fmt.Errorf("unknown decode step %q (base64, gunzip or none)", step)
+		}
+	}
+	return parsed, nil
+}
+
+// Perm returns the FileMode, or the SecretFileMode for data of Secrets
+func (p Pipeline) Perm(secret bool) os.FileMode {
+	mode := p.FileMode
+	if secret {
+		mode = p.SecretFileMode
+	}
+	perm, err := parseFileMode(mode)
+	if err != nil {
+		return 0644
+	}
+	return perm
+}
+
+func parseFileMode(mode string) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, fmt.Errorf("wrong file mode %q (octal, e.g. 0600)", mode)
+	}
+	return os.FileMode(perm), nil
+}
+
 func (c Config) String() string {
 	b, err := yaml.Marshal(c)
 	if err != nil {
@@ -93,6 +535,15 @@ func (c Config) String() string {
 	return string(b)
 }
 
+// AllPipelines returns the top-level (implicit) pipeline, if configured, followed by Pipelines.
+func (c Config) AllPipelines() []Pipeline {
+	var pipelines []Pipeline
+	if len(c.Selectors) > 0 {
+		pipelines = append(pipelines, c.Pipeline)
+	}
+	return append(pipelines, c.Pipelines...)
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
 func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	// We want to set c to the defaults and then overwrite it with the input.
@@ -103,35 +554,59 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
-	if c.Template != "" && c.ToFileName == "" {
-		return fmt.Errorf("missing ToFileName")
-	}
-
-	if (c.ToSecretName != "" || c.ToConfigMapName != "") && c.ToNamespace == "" {
-		return fmt.Errorf("missing ToNamespace")
-	}
-
-	if len(c.Selectors) == 0 {
+	if len(c.Selectors) == 0 && len(c.Pipelines) == 0 {
 		return fmt.Errorf("missing Selectors")
 	}
 
-	if c.ToSecretName == "" && c.ToConfigMapName == "" && c.ToFileName == "" {
-
+	if len(c.Selectors) > 0 {
+		if c.Name == "" {
+			c.Name = "default"
+		}
+		if err := c.Pipeline.validate(); err != nil {
+			return err
+		}
 	}
 
-	for _, selector := range c.Selectors {
-		sel := strings.Split(selector, "/")
-		if len(sel) != 2 {
-			return fmt.Errorf("missing Selectors")
+	for i := range c.Pipelines {
+		p := &c.Pipelines[i]
+		if p.Name == "" {
+			return fmt.Errorf("missing Name for pipeline %d", i)
 		}
+		if len(p.Selectors) == 0 {
+			return fmt.Errorf("missing Selectors for pipeline %s", p.Name)
+		}
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("pipeline %s: %s", p.Name, err)
+		}
+		if err := checkOverflow(p.XXX, "pipeline "+p.Name); err != nil {
+			return err
+		}
+	}
 
-		if sel[0] != "configmap" && sel[0] != "secret" {
-			return fmt.Errorf("Wrong kind for Selectors")
+	names := map[string]bool{}
+	for _, p := range c.AllPipelines() {
+		if names[p.Name] {
+			return fmt.Errorf("duplicate pipeline Name %q", p.Name)
 		}
+		names[p.Name] = true
 	}
 
-	if c.CheckYaml && c.CheckJSON {
-		return fmt.Errorf("Check syntax for Yaml and Json (Yaml!=Json)")
+	// pipelines render concurrently, none may write the file of another one
+	paths := map[string]string{} // path -> pipeline Name
+	for _, p := range c.AllPipelines() {
+		var files []string
+		if p.CheckCommand != "" {
+			files = append(files, filepath.Clean(p.TmpDirectory+p.ToFileName))
+		}
+		if p.Template != "" || p.Merge != "" {
+			files = append(files, filepath.Clean(p.ToDirectory+p.ToFileName))
+		}
+		for _, file := range files {
+			if other, ok := paths[file]; ok && other != p.Name {
+				return fmt.Errorf("pipelines %s and %s both write %s, set TmpDirectory, ToDirectory or ToFileName", other, p.Name, file)
+			}
+			paths[file] = p.Name
+		}
 	}
 
 	if c.PrometheusMetricsPort == 0 {
@@ -142,13 +617,163 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		c.PrometheusMetricsURL = "/metrics"
 	}
 
-	if len(c.CheckCommandOKExitCode) == 0 {
-		c.CheckCommandOKExitCode = []int{0}
+	if c.ResyncInterval == 0 {
+		c.ResyncInterval = 5 * time.Minute
+	}
+	if c.ResyncInterval < 0 {
+		return fmt.Errorf("ResyncInterval must be positive")
+	}
+
+	if c.HealthStuckTimeout == 0 {
+		c.HealthStuckTimeout = 5 * time.Minute
+	}
+	if c.HealthStartupTimeout == 0 {
+		c.HealthStartupTimeout = 10 * time.Minute
+	}
+	if c.HealthWatchDownTimeout == 0 {
+		c.HealthWatchDownTimeout = 5 * time.Minute
+	}
+	if c.HealthStuckTimeout < 0 || c.HealthStartupTimeout < 0 || c.HealthWatchDownTimeout < 0 {
+		return fmt.Errorf("HealthStuckTimeout, HealthStartupTimeout and HealthWatchDownTimeout must be positive")
+	}
+	if c.ShutdownGracePeriod == 0 {
+		c.ShutdownGracePeriod = 20 * time.Second
+	}
+	if c.ShutdownGracePeriod < 0 {
+		return fmt.Errorf("ShutdownGracePeriod must be positive")
+	}
+
+	switch c.Mode {
+	case "":
+		c.Mode = ModeWatch
+	case ModeWatch, ModeOnce:
+	default:
+		return fmt.Errorf("unknown Mode %q (watch|once)", c.Mode)
 	}
 
 	return checkOverflow(c.XXX, "config")
 }
 
+// validate checks the pipeline and sets its defaults.
+func (p *Pipeline) validate() error {
+	if (p.Template != "" || p.Merge != "") && p.ToFileName == "" {
+		return fmt.Errorf("missing ToFileName")
+	}
+
+	switch p.Merge {
+	case "", "yaml", "json":
+	default:
+		return fmt.Errorf("unknown Merge %q (yaml|json)", p.Merge)
+	}
+	if p.Merge != "" && p.Template != "" {
+		return fmt.Errorf("Merge and Template are exclusive")
+	}
+	switch p.MergeListStrategy {
+	case "":
+		p.MergeListStrategy = "append"
+	case "append", "replace":
+	default:
+		return fmt.Errorf("unknown MergeListStrategy %q (append|replace)", p.MergeListStrategy)
+	}
+	for _, byKey := range p.MergeByKey {
+		i := strings.LastIndex(byKey, "[].")
+		if i <= 0 || i+len("[].") == len(byKey) {
+			return fmt.Errorf("wrong MergeByKey %q (list[].key)", byKey)
+		}
+	}
+
+	if p.NamespaceSelector != "" || len(p.IncludeNamespaces) > 0 || len(p.ExcludeNamespaces) > 0 {
+		if p.FromNamespace != "" && p.FromNamespace != "ALL" {
+			return fmt.Errorf("FromNamespace %s and NamespaceSelector/IncludeNamespaces/ExcludeNamespaces are exclusive", p.FromNamespace)
+		}
+		for _, pattern := range append(append([]string{}, p.IncludeNamespaces...), p.ExcludeNamespaces...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("wrong namespace pattern %q: %v", pattern, err)
+			}
+		}
+	}
+
+	if (p.ToSecretName != "" || p.ToConfigMapName != "") && p.ToNamespace == "" {
+		return fmt.Errorf("missing ToNamespace")
+	}
+
+	if p.CheckYaml && p.CheckJSON {
+		return fmt.Errorf("Check syntax for Yaml and Json (Yaml!=Json)")
+	}
+
+	if len(p.CheckCommandOKExitCode) == 0 {
+		p.CheckCommandOKExitCode = []int{0}
+	}
+
+	if p.TargetDirAnnotation == "" {
+		p.TargetDirAnnotation = "k8s-sidecar/target-dir"
+	}
+	if p.TargetNameAnnotation == "" {
+		p.TargetNameAnnotation = "k8s-sidecar/target-name"
+	}
+
+	if len(p.SortBy) == 0 {
+		p.SortBy = []string{"priority"}
+	}
+	for _, key := range p.SortBy {
+		switch {
+		case key == "priority", key == "namespace", key == "name", key == "kind":
+		case strings.HasPrefix(key, "label:"), strings.HasPrefix(key, "annotation:"):
+		default:
+			return fmt.Errorf("unknown SortBy key %q", key)
+		}
+	}
+	if p.PriorityKey == "" {
+		p.PriorityKey = "k8s-sidecar/priority"
+	}
+
+	if p.DebounceWindow < 0 || p.DebounceMaxWait < 0 {
+		return fmt.Errorf("DebounceWindow and DebounceMaxWait must be positive")
+	}
+	if p.DebounceMaxWait == 0 {
+		p.DebounceMaxWait = 10 * p.DebounceWindow
+	}
+	if p.DebounceMaxWait < p.DebounceWindow {
+		return fmt.Errorf("DebounceMaxWait must not be shorter than DebounceWindow")
+	}
+
+	switch p.WriteMode {
+	case "":
+		p.WriteMode = WriteModeRename
+	case WriteModeRename, WriteModeSymlink:
+	default:
+		return fmt.Errorf("unknown WriteMode %q", p.WriteMode)
+	}
+
+	if p.LastGoodDirectory == "" {
+		p.LastGoodDirectory = p.TmpDirectory
+	}
+	if p.LastGoodDirectory == "" {
+		p.LastGoodDirectory = filepath.Join(os.TempDir(), "k8s-sidecar")
+	}
+
+	if p.FileMode == "" {
+		p.FileMode = "0644"
+	}
+	if p.SecretFileMode == "" {
+		p.SecretFileMode = p.FileMode
+	}
+	for _, mode := range []string{p.FileMode, p.SecretFileMode} {
+		if _, err := parseFileMode(mode); err != nil {
+			return err
+		}
+	}
+	decode, err := ParseDecode(strings.Join(p.Decode, ","))
+	if err != nil {
+		return err
+	}
+	p.Decode = decode
+	if p.DecodeAnnotation == "" {
+		p.DecodeAnnotation = "k8s-sidecar/decode"
+	}
+	return nil
+}
+
 func checkOverflow(m map[string]interface{}, ctx string) error {
 	if len(m) > 0 {
 		var keys []string
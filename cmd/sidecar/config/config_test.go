@@ -0,0 +1,364 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestURLReloadUnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    URLReload
+		wantErr bool
+	}{
+		{
+			name: "string",
+			in:   `http://localhost:3000/reload`,
+			want: URLReload{URL: "http://localhost:3000/reload", Method: "GET", Timeout: 10 * time.Second, RetryBackoff: time.Second},
+		},
+		{
+			name: "struct",
+			in:   "{URL: http://localhost/-/reload, Method: post, Timeout: 5s, Retries: 3, RetryBackoff: 2s, ExpectedStatusCodes: [200, 204]}",
+			want: URLReload{
+				URL:                 "http://localhost/-/reload",
+				Method:              "POST",
+				Timeout:             5 * time.Second,
+				Retries:             3,
+				RetryBackoff:        2 * time.Second,
+				ExpectedStatusCodes: []int{200, 204},
+			},
+		},
+		{
+			name: "basic auth",
+			in:   "{URL: http://localhost, BasicAuth: {Username: admin, PasswordFile: /etc/password}}",
+			want: URLReload{
+				URL:          "http://localhost",
+				Method:       "GET",
+				BasicAuth:    &BasicAuth{Username: "admin", PasswordFile: "/etc/password"},
+				Timeout:      10 * time.Second,
+				RetryBackoff: time.Second,
+			},
+		},
+		{name: "missing URL", in: "{Method: POST}", wantErr: true},
+		{name: "empty string", in: `""`, wantErr: true},
+		{name: "basic auth and bearer token", in: "{URL: http://localhost, BasicAuth: {Username: admin, PasswordFile: /p}, BearerTokenFile: /t}", wantErr: true},
+		{name: "basic auth without password", in: "{URL: http://localhost, BasicAuth: {Username: admin}}", wantErr: true},
+		{name: "negative retries", in: "{URL: http://localhost, Retries: -1}", wantErr: true},
+		{name: "negative timeout", in: "{URL: http://localhost, Timeout: -1s}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got URLReload
+			err := yaml.Unmarshal([]byte(tt.in), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHookUnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    Hook
+		wantErr bool
+	}{
+		{
+			name: "string",
+			in:   `nginx -t`,
+			want: Hook{Command: "nginx -t", Timeout: 30 * time.Second},
+		},
+		{
+			name: "struct",
+			in:   "{Command: nginx -t, Timeout: 5s, FailOnError: true}",
+			want: Hook{Command: "nginx -t", Timeout: 5 * time.Second, FailOnError: true},
+		},
+		{name: "empty string", in: `""`, wantErr: true},
+		{name: "missing Command", in: "{Timeout: 5s}", wantErr: true},
+		{name: "negative timeout", in: "{Command: nginx -t, Timeout: -5s}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Hook
+			err := yaml.Unmarshal([]byte(tt.in), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectorUnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    Selector
+		wantErr bool
+	}{
+		{
+			name: "string",
+			in:   `configmap/app=x`,
+			want: Selector{APIVersion: "v1", Version: "v1", Kind: KindConfigMap, LabelSelector: "app=x"},
+		},
+		{
+			name: "core kind",
+			in:   "{Kind: ConfigMap, LabelSelector: app=x, Names: [grafana-*], IncludeKeys: ['*.json']}",
+			want: Selector{
+				APIVersion:    "v1",
+				Version:       "v1",
+				Kind:          KindConfigMap,
+				LabelSelector: "app=x",
+				Names:         []string{"grafana-*"},
+				IncludeKeys:   []string{"*.json"},
+			},
+		},
+		{
+			name: "dynamic kind",
+			in:   "{APIVersion: monitoring.coreos.com/v1, Kind: PrometheusRule, FieldSelector: metadata.name=x, Annotations: {team: '*'}}",
+			want: Selector{
+				APIVersion:    "monitoring.coreos.com/v1",
+				Group:         "monitoring.coreos.com",
+				Version:       "v1",
+				Kind:          "PrometheusRule",
+				FieldSelector: "metadata.name=x",
+				Annotations:   map[string]string{"team": "*"},
+			},
+		},
+		{
+			name: "core group kind",
+			in:   "{APIVersion: v1, Kind: Service}",
+			want: Selector{APIVersion: "v1", Version: "v1", Kind: "Service"},
+		},
+		{name: "wrong string", in: `app=x`, wantErr: true},
+		{name: "missing Kind", in: "{LabelSelector: app=x}", wantErr: true},
+		{name: "wrong APIVersion", in: "{APIVersion: a/b/c, Kind: Foo}", wantErr: true},
+		{name: "wrong NameRegex", in: "{Kind: configmap, NameRegex: '('}", wantErr: true},
+		{name: "wrong pattern", in: "{Kind: configmap, ExcludeKeys: ['[']}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Selector
+			err := yaml.Unmarshal([]byte(tt.in), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDecode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "base64", want: []string{DecodeBase64}},
+		{in: "Base64, gunzip", want: []string{DecodeBase64, DecodeGunzip}},
+		{in: "none"},
+		{in: ""},
+		{in: "rot13", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseDecode(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPipelinePerm(t *testing.T) {
+	tests := []struct {
+		name    string
+		modes   string
+		perm    os.FileMode
+		secret  os.FileMode
+		wantErr bool
+	}{
+		{name: "default", perm: 0644, secret: 0644},
+		{name: "FileMode", modes: `FileMode: "0600"`, perm: 0600, secret: 0600},
+		{name: "SecretFileMode", modes: `SecretFileMode: "0400"`, perm: 0644, secret: 0400},
+		{name: "not octal", modes: `FileMode: "0900"`, wantErr: true},
+		{name: "too large", modes: `SecretFileMode: "01777"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := LoadConfig("Selectors: [configmap/app=x]\nToDirectory: /tmp/out/\n" + tt.modes + "\n")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			p := c.AllPipelines()[0]
+			if perm := p.Perm(false); perm != tt.perm {
+				t.Errorf("Perm(false) = %o, want %o", perm, tt.perm)
+			}
+			if secret := p.Perm(true); secret != tt.secret {
+				t.Errorf("Perm(true) = %o, want %o", secret, tt.secret)
+			}
+		})
+	}
+}
+
+func TestSignalReloadUnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    SignalReload
+		target  string
+		wantErr bool
+	}{
+		{
+			name:   "process with default signal",
+			in:     "{Process: nginx}",
+			want:   SignalReload{Process: "nginx", Signal: "SIGHUP"},
+			target: "process:nginx",
+		},
+		{
+			name:   "pid file with short signal",
+			in:     "{PidFile: /run/nginx.pid, Signal: usr1}",
+			want:   SignalReload{PidFile: "/run/nginx.pid", Signal: "SIGUSR1"},
+			target: "pidfile:/run/nginx.pid",
+		},
+		{name: "neither", in: "{Signal: SIGHUP}", wantErr: true},
+		{name: "both", in: "{Process: nginx, PidFile: /run/nginx.pid}", wantErr: true},
+		{name: "unknown signal", in: "{Process: nginx, Signal: SIGKILL}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got SignalReload
+			err := yaml.Unmarshal([]byte(tt.in), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if target := got.Target(); target != tt.target {
+				t.Errorf("Target() = %s, want %s", target, tt.target)
+			}
+		})
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Selector
+		dynamic bool
+		wantErr bool
+	}{
+		{in: "configmap/app=x", want: Selector{APIVersion: "v1", Version: "v1", Kind: KindConfigMap, LabelSelector: "app=x"}},
+		{in: "secret/", want: Selector{APIVersion: "v1", Version: "v1", Kind: KindSecret}},
+		{
+			in:   "configmap/app.kubernetes.io/name=grafana",
+			want: Selector{APIVersion: "v1", Version: "v1", Kind: KindConfigMap, LabelSelector: "app.kubernetes.io/name=grafana"},
+		},
+		{in: "v1/Service/app=x", want: Selector{APIVersion: "v1", Version: "v1", Kind: "Service", LabelSelector: "app=x"}, dynamic: true},
+		{in: "v1/Service", want: Selector{APIVersion: "v1", Version: "v1", Kind: "Service"}, dynamic: true},
+		{
+			in:      "monitoring.coreos.com/v1/PrometheusRule/team=x",
+			want:    Selector{APIVersion: "monitoring.coreos.com/v1", Group: "monitoring.coreos.com", Version: "v1", Kind: "PrometheusRule", LabelSelector: "team=x"},
+			dynamic: true,
+		},
+		{
+			in:      "example.com/v1beta1/Widget/app.kubernetes.io/part-of=x",
+			want:    Selector{APIVersion: "example.com/v1beta1", Group: "example.com", Version: "v1beta1", Kind: "Widget", LabelSelector: "app.kubernetes.io/part-of=x"},
+			dynamic: true,
+		},
+		{in: "app=x", wantErr: true},
+		{in: "configmap", wantErr: true},
+		{in: "v1/ConfigMap/app=x", wantErr: true},
+		{in: "example.com/v1/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseSelector(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if got.Dynamic() != tt.dynamic {
+				t.Errorf("Dynamic() = %v, want %v", got.Dynamic(), tt.dynamic)
+			}
+		})
+	}
+}
+
+func TestConfigDuplicatePaths(t *testing.T) {
+	tests := []struct {
+		name      string
+		pipelines string
+		wantErr   bool
+	}{
+		{
+			name: "different files",
+			pipelines: `
+- {Name: a, Selectors: [configmap/app=a], Template: x, CheckCommand: "true", TmpDirectory: /tmp/, ToDirectory: /out/, ToFileName: a.conf}
+- {Name: b, Selectors: [configmap/app=b], Template: x, CheckCommand: "true", TmpDirectory: /tmp/, ToDirectory: /out/, ToFileName: b.conf}`,
+		},
+		{
+			name: "same output",
+			pipelines: `
+- {Name: a, Selectors: [configmap/app=a], Template: x, ToDirectory: /out/, ToFileName: a.conf}
+- {Name: b, Selectors: [configmap/app=b], Merge: yaml, ToDirectory: /out//, ToFileName: a.conf}`,
+			wantErr: true,
+		},
+		{
+			name: "same CheckCommand file",
+			pipelines: `
+- {Name: a, Selectors: [configmap/app=a], Template: x, CheckCommand: "true", TmpDirectory: /tmp/, ToDirectory: /a/, ToFileName: out.conf}
+- {Name: b, Selectors: [configmap/app=b], Template: x, CheckCommand: "true", TmpDirectory: /tmp/, ToDirectory: /b/, ToFileName: out.conf}`,
+			wantErr: true,
+		},
+		{
+			name: "CheckCommand file is the output of another pipeline",
+			pipelines: `
+- {Name: a, Selectors: [configmap/app=a], Template: x, CheckCommand: "true", TmpDirectory: /out/, ToDirectory: /a/, ToFileName: out.conf}
+- {Name: b, Selectors: [configmap/app=b], Template: x, ToDirectory: /out/, ToFileName: out.conf}`,
+			wantErr: true,
+		},
+		{
+			name: "same file without CheckCommand",
+			pipelines: `
+- {Name: a, Selectors: [configmap/app=a], Template: x, TmpDirectory: /tmp/, ToDirectory: /a/, ToFileName: out.conf}
+- {Name: b, Selectors: [configmap/app=b], Template: x, TmpDirectory: /tmp/, ToDirectory: /b/, ToFileName: out.conf}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig("Pipelines:" + tt.pipelines + "\n")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "time"
+
+// batch collects the changes of a pipeline until window passed without a new
+// one, but at most maxWait after the first change of the batch.
+type batch struct {
+	window   time.Duration
+	maxWait  time.Duration
+	pending  int       // changes received since the last render
+	deadline time.Time // maxWait after the first change
+}
+
+// add counts n changes received at now and returns how long to wait for the render
+func (b *batch) add(n int, now time.Time) time.Duration {
+	if b.pending == 0 {
+		b.deadline = now.Add(b.maxWait)
+	}
+	b.pending += n
+	wait := b.window
+	if left := b.deadline.Sub(now); left < wait {
+		wait = left
+	}
+	return wait
+}
+
+// take returns the number of changes of the batch and starts a new one
+func (b *batch) take() int {
+	pending := b.pending
+	b.pending = 0
+	return pending
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBatchAdd(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	type change struct {
+		after time.Duration // since start
+		n     int
+		wait  time.Duration
+	}
+	tests := []struct {
+		name    string
+		window  time.Duration
+		maxWait time.Duration
+		changes []change
+		pending int
+	}{
+		{
+			name:    "no debounce",
+			changes: []change{{0, 1, 0}, {0, 1, 0}},
+			pending: 2,
+		},
+		{
+			name:    "every change restarts the window",
+			window:  2 * time.Second,
+			maxWait: 20 * time.Second,
+			changes: []change{{0, 1, 2 * time.Second}, {time.Second, 3, 2 * time.Second}},
+			pending: 4,
+		},
+		{
+			name:    "maxWait limits the window",
+			window:  2 * time.Second,
+			maxWait: 5 * time.Second,
+			changes: []change{{0, 1, 2 * time.Second}, {4 * time.Second, 1, time.Second}, {5 * time.Second, 1, 0}},
+			pending: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &batch{window: tt.window, maxWait: tt.maxWait}
+			for i, c := range tt.changes {
+				if wait := b.add(c.n, start.Add(c.after)); wait != c.wait {
+					t.Errorf("change %d: wait %s, want %s", i, wait, c.wait)
+				}
+			}
+			if pending := b.take(); pending != tt.pending {
+				t.Errorf("take %d, want %d", pending, tt.pending)
+			}
+			if pending := b.take(); pending != 0 {
+				t.Errorf("take after take %d, want 0", pending)
+			}
+		})
+	}
+}
+
+func TestBatchNewDeadlineAfterTake(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := &batch{window: 2 * time.Second, maxWait: 5 * time.Second}
+	b.add(1, start)
+	b.take()
+	if wait := b.add(1, start.Add(10*time.Second)); wait != 2*time.Second {
+		t.Errorf("wait %s in a new batch, want the whole window", wait)
+	}
+}
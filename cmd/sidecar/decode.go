@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+)
+
+// decode applies the Decode steps of the pipeline, or the steps of its
+// DecodeAnnotation, to every entry of e. A gunzipped key loses its ".gz" suffix,
+// entries that fail to decode are dropped.
+func (p *pipeline) decode(e Event) Event {
+	steps := p.conf.Decode
+	if value, ok := e.annotations[p.conf.DecodeAnnotation]; ok {
+		var err error
+		if steps, err = config.ParseDecode(value); err != nil {
+			log.Warnf("%s annotation %s: %v", e.cmid, p.conf.DecodeAnnotation, err)
+			steps = p.conf.Decode
+		}
+	}
+	if len(steps) == 0 {
+		return e
+	}
+	entries := make([]Entry, 0, len(e.entry))
+	for _, ent := range e.entry {
+		decoded, err := decodeValue(ent.data, steps)
+		if err != nil {
+			log.Errorf("%s key %s not decoded: %v", e.cmid, ent.name, err)
+			continue
+		}
+		name := ent.name
+		for _, step := range steps {
+			if step == config.DecodeGunzip {
+				name = strings.TrimSuffix(name, ".gz")
+			}
+		}
+		entries = append(entries, Entry{name: name, data: decoded})
+	}
+	e.entry = entries
+	return e
+}
+
+// decodeValue applies the decode steps to data in order
+func decodeValue(data []byte, steps []string) ([]byte, error) {
+	for _, step := range steps {
+		switch step {
+		case config.DecodeBase64:
+			decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+			n, err := base64.StdEncoding.Decode(decoded, bytes.TrimSpace(data))
+			if err != nil {
+				return nil, fmt.Errorf("base64: %v", err)
+			}
+			data = decoded[:n]
+		case config.DecodeGunzip:
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("gunzip: %v", err)
+			}
+			decoded, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, fmt.Errorf("gunzip: %v", err)
+			}
+			data = decoded
+		}
+	}
+	return data, nil
+}
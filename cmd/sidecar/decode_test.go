@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeValue(t *testing.T) {
+	b64 := func(data []byte) []byte { return []byte(base64.StdEncoding.EncodeToString(data)) }
+	tests := []struct {
+		name    string
+		data    []byte
+		steps   []string
+		want    string
+		wantErr bool
+	}{
+		{name: "no step", data: []byte("plain"), want: "plain"},
+		{name: "base64", data: b64([]byte("plain")), steps: []string{config.DecodeBase64}, want: "plain"},
+		{name: "base64 with newline", data: append(b64([]byte("plain")), '\n'), steps: []string{config.DecodeBase64}, want: "plain"},
+		{name: "gunzip", data: gzipped(t, "plain"), steps: []string{config.DecodeGunzip}, want: "plain"},
+		{name: "base64 then gunzip", data: b64(gzipped(t, "plain")), steps: []string{config.DecodeBase64, config.DecodeGunzip}, want: "plain"},
+		{name: "wrong base64", data: []byte("not base64!"), steps: []string{config.DecodeBase64}, wantErr: true},
+		{name: "not gzipped", data: []byte("plain"), steps: []string{config.DecodeGunzip}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeValue(tt.data, tt.steps)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPipelineDecode(t *testing.T) {
+	const conf = `
+Selectors: ["configmap/app=x"]
+ToDirectory: /tmp/out/
+Decode: [gunzip]
+`
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		entries     []Entry
+		want        []Entry
+	}{
+		{
+			name:    "gunzip drops .gz",
+			entries: []Entry{{name: "a.conf.gz", data: gzipped(t, "a")}, {name: "b.conf", data: gzipped(t, "b")}},
+			want:    []Entry{{name: "a.conf", data: []byte("a")}, {name: "b.conf", data: []byte("b")}},
+		},
+		{
+			name:    "failed key dropped",
+			entries: []Entry{{name: "a.conf.gz", data: gzipped(t, "a")}, {name: "b.conf.gz", data: []byte("b")}},
+			want:    []Entry{{name: "a.conf", data: []byte("a")}},
+		},
+		{
+			name:        "annotation none",
+			annotations: map[string]string{"k8s-sidecar/decode": "none"},
+			entries:     []Entry{{name: "a.conf.gz", data: []byte("a")}},
+			want:        []Entry{{name: "a.conf.gz", data: []byte("a")}},
+		},
+		{
+			name:        "annotation base64",
+			annotations: map[string]string{"k8s-sidecar/decode": "base64"},
+			entries:     []Entry{{name: "a.conf", data: []byte(base64.StdEncoding.EncodeToString([]byte("a")))}},
+			want:        []Entry{{name: "a.conf", data: []byte("a")}},
+		},
+		{
+			name:        "wrong annotation keeps Decode",
+			annotations: map[string]string{"k8s-sidecar/decode": "rot13"},
+			entries:     []Entry{{name: "a.conf.gz", data: gzipped(t, "a")}},
+			want:        []Entry{{name: "a.conf", data: []byte("a")}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testPipeline(t, conf)
+			e := testEvent("default", "a", "1", nil)
+			e.annotations = tt.annotations
+			e.entry = tt.entries
+			if got := p.decode(e).entry; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+)
+
+// dynamicResource returns the client of the resource of sel, the namespace is
+// ignored for cluster scoped resources. An unknown kind resets the cached
+// discovery once, its CRD may have been installed since.
+func (s *sharedInformers) dynamicResource(namespace string, sel selector) (dynamic.ResourceInterface, error) {
+	gk := schema.GroupKind{Group: sel.group, Kind: sel.kind}
+	mapping, err := s.mapper.RESTMapping(gk, sel.version)
+	if meta.IsNoMatchError(err) {
+		s.mapper.Reset()
+		mapping, err = s.mapper.RESTMapping(gk, sel.version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("selector %s: %v", sel, err)
+	}
+	resource := s.dynamic.Resource(mapping.Resource)
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		return resource.Namespace(namespace), nil
+	}
+	return resource, nil
+}
+
+// newDynamicInformer creates the informer of any kind, objects are *unstructured.Unstructured.
+func (s *sharedInformers) newDynamicInformer(namespace string, sel selector, w *watchState) (cache.SharedIndexInformer, error) {
+	resource, err := s.dynamicResource(namespace, sel)
+	if err != nil {
+		return nil, err
+	}
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = sel.fieldSelector
+			return resource.List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = sel.fieldSelector
+			return resource.Watch(options)
+		},
+	}
+	return cache.NewSharedIndexInformer(sidecarHealth.trackWatch(w, lw), &unstructured.Unstructured{}, 0, cache.Indexers{}), nil
+}
+
+// listDynamic lists the objects of any kind matching sel
+func (s *sharedInformers) listDynamic(namespace string, sel selector) ([]interface{}, error) {
+	resource, err := s.dynamicResource(namespace, sel)
+	if err != nil {
+		return nil, err
+	}
+	list, err := resource.List(metav1.ListOptions{LabelSelector: sel.labelSelector, FieldSelector: sel.fieldSelector})
+	if err != nil {
+		return nil, err
+	}
+	var objs []interface{}
+	for i := range list.Items {
+		objs = append(objs, &list.Items[i])
+	}
+	return objs, nil
+}
+
+// unstructuredEntries returns every top-level field of o except apiVersion, kind,
+// metadata and status as YAML entry (e.g. "spec")
+func unstructuredEntries(o *unstructured.Unstructured) []Entry {
+	var keys []string
+	for key := range o.Object {
+		switch key {
+		case "apiVersion", "kind", "metadata", "status":
+		default:
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var entries []Entry
+	for _, key := range keys {
+		data, err := yaml.Marshal(o.Object[key])
+		if err != nil {
+			log.Warnf("%s/%s field %s: %v", o.GetNamespace(), o.GetName(), key, err)
+			continue
+		}
+		entries = append(entries, Entry{name: key, data: data})
+	}
+	return entries
+}
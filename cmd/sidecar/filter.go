@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// toEvent is objectToEvent for the objects of the informer of s, false if the
+// object does not pass the names, nameRegex and annotations filters of s or no
+// data key is left after includeKeys and excludeKeys.
+func (s selector) toEvent(obj interface{}, action string) (Event, bool) {
+	e, ok := objectToEvent(obj, action)
+	if !ok || !s.match(e) {
+		return e, false
+	}
+	if len(s.includeKeys) == 0 && len(s.excludeKeys) == 0 {
+		return e, true
+	}
+	var entries []Entry
+	for _, entry := range e.entry {
+		if s.keep(entry.name) {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		log.Debugf("%s: no data key left by selector %s", e.cmid, s)
+		return e, false
+	}
+	e.entry = entries
+	return e, true
+}
+
+// match checks the labels, name and annotations of e
+func (s selector) match(e Event) bool {
+	if s.labels != nil && !s.labels.Matches(labels.Set(e.labels)) {
+		return false
+	}
+	if !matchAny(s.names, e.name) {
+		return false
+	}
+	if s.nameRegex != nil && !s.nameRegex.MatchString(e.name) {
+		return false
+	}
+	for key, pattern := range s.annotations {
+		value, ok := e.annotations[key]
+		if !ok {
+			return false
+		}
+		if matched, _ := path.Match(pattern, value); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// keep checks a data key against includeKeys and excludeKeys
+func (s selector) keep(key string) bool {
+	if !matchAny(s.includeKeys, key) {
+		return false
+	}
+	return len(s.excludeKeys) == 0 || !matchAny(s.excludeKeys, key)
+}
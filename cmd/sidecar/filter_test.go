@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSelectorMatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		sel         selector
+		event       string
+		annotations map[string]string
+		want        bool
+	}{
+		{name: "no filter", event: "a", want: true},
+		{name: "names", sel: selector{names: []string{"grafana-*", "b"}}, event: "grafana-x", want: true},
+		{name: "names no match", sel: selector{names: []string{"grafana-*", "b"}}, event: "prometheus", want: false},
+		{name: "regex", sel: selector{nameRegex: regexp.MustCompile(`^dash-[0-9]+$`)}, event: "dash-1", want: true},
+		{name: "regex no match", sel: selector{nameRegex: regexp.MustCompile(`^dash-[0-9]+$`)}, event: "dash-x", want: false},
+		{
+			name:        "annotations",
+			sel:         selector{annotations: map[string]string{"team": "*", "env": "prod-*"}},
+			event:       "a",
+			annotations: map[string]string{"team": "x", "env": "prod-eu"},
+			want:        true,
+		},
+		{
+			name:        "annotation value no match",
+			sel:         selector{annotations: map[string]string{"env": "prod-*"}},
+			event:       "a",
+			annotations: map[string]string{"env": "dev"},
+			want:        false,
+		},
+		{
+			name:  "annotation missing",
+			sel:   selector{annotations: map[string]string{"team": "*"}},
+			event: "a",
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := testEvent("default", tt.event, "1", nil)
+			e.annotations = tt.annotations
+			if got := tt.sel.match(e); got != tt.want {
+				t.Errorf("match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectorToEvent(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "a", ResourceVersion: "1"},
+		Data:       map[string]string{"a.json": "{}", "b.json": "{}", "c.yaml": "c"},
+	}
+	tests := []struct {
+		name string
+		sel  selector
+		keys []string // nil if the object is skipped
+	}{
+		{name: "all keys", keys: []string{"a.json", "b.json", "c.yaml"}},
+		{name: "include", sel: selector{includeKeys: []string{"*.json"}}, keys: []string{"a.json", "b.json"}},
+		{name: "exclude", sel: selector{excludeKeys: []string{"b.*"}}, keys: []string{"a.json", "c.yaml"}},
+		{name: "include and exclude", sel: selector{includeKeys: []string{"*.json"}, excludeKeys: []string{"a.*"}}, keys: []string{"b.json"}},
+		{name: "no key left", sel: selector{includeKeys: []string{"*.xml"}}},
+		{name: "name does not match", sel: selector{names: []string{"b"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, ok := tt.sel.toEvent(cm, "added")
+			if ok != (tt.keys != nil) {
+				t.Fatalf("ok = %v, want %v", ok, tt.keys != nil)
+			}
+			if !ok {
+				return
+			}
+			var keys []string
+			for _, entry := range e.entry {
+				keys = append(keys, entry.name)
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, tt.keys) {
+				t.Errorf("keys %v, want %v", keys, tt.keys)
+			}
+			if e.cmid != "default/a" || e.action != "added" {
+				t.Errorf("event %s %s, want added default/a", e.action, e.cmid)
+			}
+		})
+	}
+}
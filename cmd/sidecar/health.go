@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Paths of the probes on the PrometheusMetricsPort
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// heartbeatInterval how often an idle pipeline loop tells it is alive
+const heartbeatInterval = 10 * time.Second
+
+// health collects the state of the pipeline loops and watches for the probes.
+// /healthz fails when a loop did not come around for HealthStuckTimeout, a
+// pipeline did not get through its initial sync and first render for
+// HealthStartupTimeout or a watch fails for HealthWatchDownTimeout,
+// /readyz fails until every pipeline synced its sources and rendered its outputs.
+type health struct {
+	mu             sync.Mutex
+	stuckTimeout   time.Duration
+	startupTimeout time.Duration
+	watchTimeout   time.Duration
+	pipelines      map[string]*pipelineState
+	watches        map[*watchState]bool
+	registrations  int // pipelines registered since start, no readiness before the first one
+}
+
+type pipelineState struct {
+	ready     bool
+	started   bool      // the loop came around once, after the initial sync and first render
+	heartbeat time.Time // registration until started
+	failed    error     // run of the pipeline returned before it was stopped
+}
+
+type watchState struct {
+	name      string
+	downSince time.Time // zero while the watch works
+}
+
+var sidecarHealth = newHealth()
+
+func newHealth() *health {
+	return &health{
+		stuckTimeout:   5 * time.Minute,
+		startupTimeout: 10 * time.Minute,
+		watchTimeout:   5 * time.Minute,
+		pipelines:      make(map[string]*pipelineState),
+		watches:        make(map[*watchState]bool),
+	}
+}
+
+// configure sets the thresholds of /healthz
+func (h *health) configure(stuckTimeout, startupTimeout, watchTimeout time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stuckTimeout = stuckTimeout
+	h.startupTimeout = startupTimeout
+	h.watchTimeout = watchTimeout
+}
+
+// register adds a pipeline that is not ready yet
+func (h *health) register(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pipelines[name] = &pipelineState{heartbeat: time.Now()}
+	h.registrations++
+}
+
+// unregister removes a stopped pipeline
+func (h *health) unregister(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.pipelines, name)
+}
+
+// failed keeps a pipeline that stopped on its own as failed, both probes report it
+func (h *health) failed(name string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if state, ok := h.pipelines[name]; ok {
+		state.ready = false
+		state.failed = err
+	}
+}
+
+// beat tells the loop of the pipeline is alive
+func (h *health) beat(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if state, ok := h.pipelines[name]; ok {
+		state.started = true
+		state.heartbeat = time.Now()
+	}
+}
+
+// rendered marks the pipeline ready after its first successful write and reload
+func (h *health) rendered(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if state, ok := h.pipelines[name]; ok && !state.ready {
+		log.Infof("Pipeline %s ready", name)
+		state.ready = true
+		state.heartbeat = time.Now()
+	}
+}
+
+// watch registers a watch, the result of every list/watch call is given to watchResult
+func (h *health) watch(name string) *watchState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	w := &watchState{name: name}
+	h.watches[w] = true
+	return w
+}
+
+func (h *health) watchResult(w *watchState, err error) {
+	sidecarWatchRestarts.WithLabelValues(w.name).Inc()
+	if err != nil {
+		sidecarWatchErrors.WithLabelValues(w.name).Inc()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		w.downSince = time.Time{}
+	} else if w.downSince.IsZero() {
+		w.downSince = time.Now()
+	}
+}
+
+// unwatch removes a stopped watch
+func (h *health) unwatch(w *watchState) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.watches, w)
+}
+
+// trackWatch reports the results of the calls of lw to the watch w
+func (h *health) trackWatch(w *watchState, lw *cache.ListWatch) *cache.ListWatch {
+	list, watchFunc := lw.ListFunc, lw.WatchFunc
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			obj, err := list(options)
+			h.watchResult(w, err)
+			return obj, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			wi, err := watchFunc(options)
+			h.watchResult(w, err)
+			return wi, err
+		},
+	}
+}
+
+// live returns the reasons why the sidecar is not alive
+func (h *health) live() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var problems []string
+	now := time.Now()
+	for name, state := range h.pipelines {
+		if state.failed != nil {
+			problems = append(problems, fmt.Sprintf("pipeline %s failed: %v", name, state.failed))
+			continue
+		}
+		switch since := now.Sub(state.heartbeat); {
+		case !state.started && since > h.startupTimeout:
+			problems = append(problems, fmt.Sprintf("pipeline %s not synced and rendered since %s", name, state.heartbeat.Format(time.RFC3339)))
+		case state.started && since > h.stuckTimeout:
+			problems = append(problems, fmt.Sprintf("pipeline %s stuck since %s", name, state.heartbeat.Format(time.RFC3339)))
+		}
+	}
+	for w := range h.watches {
+		if !w.downSince.IsZero() && now.Sub(w.downSince) > h.watchTimeout {
+			problems = append(problems, fmt.Sprintf("watch %s down since %s", w.name, w.downSince.Format(time.RFC3339)))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// ready returns the reasons why the sidecar is not ready
+func (h *health) ready() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.registrations == 0 {
+		return []string{"no pipeline started"}
+	}
+	var problems []string
+	for name, state := range h.pipelines {
+		if state.failed != nil {
+			problems = append(problems, fmt.Sprintf("pipeline %s failed: %v", name, state.failed))
+		} else if !state.ready {
+			problems = append(problems, fmt.Sprintf("pipeline %s not synced and rendered", name))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// probeHandler answers 200 "ok" or 503 with the problems
+func probeHandler(check func() []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if problems := check(); len(problems) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(problems, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
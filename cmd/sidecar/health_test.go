@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthLive(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		state    pipelineState
+		down     time.Duration // of a watch, 0 if it works
+		problems []string      // prefixes of the problems
+	}{
+		{name: "starting", state: pipelineState{heartbeat: now.Add(-9 * time.Minute)}},
+		{
+			name:     "first render hangs",
+			state:    pipelineState{heartbeat: now.Add(-11 * time.Minute)},
+			problems: []string{"pipeline p not synced and rendered since"},
+		},
+		{name: "running", state: pipelineState{ready: true, started: true, heartbeat: now.Add(-time.Minute)}},
+		{name: "running, not ready", state: pipelineState{started: true, heartbeat: now.Add(-time.Minute)}},
+		{
+			name:     "stuck",
+			state:    pipelineState{ready: true, started: true, heartbeat: now.Add(-6 * time.Minute)},
+			problems: []string{"pipeline p stuck since"},
+		},
+		{
+			name:     "stuck before ready",
+			state:    pipelineState{started: true, heartbeat: now.Add(-6 * time.Minute)},
+			problems: []string{"pipeline p stuck since"},
+		},
+		{
+			name:     "failed",
+			state:    pipelineState{failed: errors.New("boom"), heartbeat: now.Add(-time.Hour)},
+			problems: []string{"pipeline p failed: boom"},
+		},
+		{name: "watch down shortly", state: pipelineState{ready: true, started: true, heartbeat: now}, down: time.Minute},
+		{
+			name:     "watch down",
+			state:    pipelineState{ready: true, started: true, heartbeat: now},
+			down:     6 * time.Minute,
+			problems: []string{"watch w down since"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHealth()
+			h.configure(5*time.Minute, 10*time.Minute, 5*time.Minute)
+			state := tt.state
+			h.pipelines["p"] = &state
+			if tt.down > 0 {
+				h.watch("w").downSince = now.Add(-tt.down)
+			}
+			problems := h.live()
+			if len(problems) != len(tt.problems) {
+				t.Fatalf("problems %q, want %q", problems, tt.problems)
+			}
+			for i, prefix := range tt.problems {
+				if !strings.HasPrefix(problems[i], prefix) {
+					t.Errorf("problem %q, want %q", problems[i], prefix)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthReady(t *testing.T) {
+	h := newHealth()
+	if problems := h.ready(); !reflect.DeepEqual(problems, []string{"no pipeline started"}) {
+		t.Errorf("before registration %q", problems)
+	}
+	h.register("a")
+	h.register("b")
+	want := []string{"pipeline a not synced and rendered", "pipeline b not synced and rendered"}
+	if problems := h.ready(); !reflect.DeepEqual(problems, want) {
+		t.Errorf("registered %q, want %q", problems, want)
+	}
+	h.rendered("a")
+	h.failed("b", errors.New("boom"))
+	want = []string{"pipeline b failed: boom"}
+	if problems := h.ready(); !reflect.DeepEqual(problems, want) {
+		t.Errorf("a rendered, b failed %q, want %q", problems, want)
+	}
+	h.unregister("b")
+	if problems := h.ready(); len(problems) != 0 {
+		t.Errorf("a rendered %q, want ready", problems)
+	}
+	// a config reload unregisters all pipelines before the new ones register
+	h.unregister("a")
+	if problems := h.ready(); len(problems) != 0 {
+		t.Errorf("between generations %q, want ready", problems)
+	}
+}
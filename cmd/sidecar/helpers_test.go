@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// testPipeline creates the pipeline of the config conf without a cluster,
+// the reporter does not report anything.
+func testPipeline(t *testing.T, conf string) *pipeline {
+	t.Helper()
+	c, err := config.LoadConfig(conf)
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	reporter := &reporter{invalids: make(map[string]bool)}
+	p, err := newPipeline(kubernetes.Clientset{}, c.AllPipelines()[0], reporter, false)
+	if err != nil {
+		t.Fatalf("pipeline: %v", err)
+	}
+	return p
+}
+
+// testEvent returns an "added" ConfigMap event of namespace/name with data
+func testEvent(namespace, name, resourceVersion string, data map[string]string) Event {
+	e := Event{
+		action:          "added",
+		cmid:            namespace + "/" + name,
+		kind:            "ConfigMap",
+		apiVersion:      "v1",
+		namespace:       namespace,
+		name:            name,
+		resourceVersion: resourceVersion,
+	}
+	for key, value := range data {
+		e.entry = append(e.entry, Entry{name: key, data: []byte(value)})
+	}
+	return e
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+)
+
+// runHooks runs the commands with env one after another, the error is the first
+// failed command with FailOnError. Other failures are logged only.
+func (p *pipeline) runHooks(ctx context.Context, hooks []config.Hook, env []string) error {
+	for _, hook := range hooks {
+		hookCtx, cancel := context.WithTimeout(ctx, hook.Timeout)
+		exitCode, output := runCommandEnv(hookCtx, hook.Command, env)
+		timedOut := hookCtx.Err() == context.DeadlineExceeded
+		cancel()
+		output = strings.TrimSpace(output)
+		if exitCode == 0 && !timedOut {
+			log.Infof("Pipeline %s: %s: %s", p.conf.Name, hook.Command, output)
+			continue
+		}
+		err := fmt.Errorf("%s exited with %d: %s", hook.Command, exitCode, output)
+		if timedOut {
+			err = fmt.Errorf("%s timed out after %s: %s", hook.Command, hook.Timeout, output)
+		}
+		if hook.FailOnError {
+			log.Errorf("Pipeline %s: %v", p.conf.Name, err)
+			return err
+		}
+		log.Warnf("Pipeline %s: %v", p.conf.Name, err)
+	}
+	return nil
+}
+
+// hookEnv describes the changes since the last render to the hooks:
+// SIDECAR_PIPELINE name of the pipeline, SIDECAR_ACTION the actions (added,
+// modified, deleted, rollback), SIDECAR_SOURCES the changed namespace/name,
+// SIDECAR_CHANGES action:namespace/name of every change and SIDECAR_OUTPUT the
+// output file, or the directories of the changed sources without Template.
+func (p *pipeline) hookEnv(action string) []string {
+	var actions, sources, changes []string
+	seen := make(map[string]bool)
+	for cmid, change := range p.changes {
+		if action != "" {
+			change = action
+		}
+		if !seen[change] {
+			seen[change] = true
+			actions = append(actions, change)
+		}
+		sources = append(sources, cmid)
+		changes = append(changes, change+":"+cmid)
+	}
+	if action != "" && len(actions) == 0 {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	sort.Strings(sources)
+	sort.Strings(changes)
+	return []string{
+		"SIDECAR_PIPELINE=" + p.conf.Name,
+		"SIDECAR_ACTION=" + strings.Join(actions, ","),
+		"SIDECAR_SOURCES=" + strings.Join(sources, ","),
+		"SIDECAR_CHANGES=" + strings.Join(changes, " "),
+		"SIDECAR_OUTPUT=" + strings.Join(p.outputPaths(), ","),
+	}
+}
+
+// outputPaths returns the output file, or the target directories of the changed sources
+func (p *pipeline) outputPaths() []string {
+	if p.conf.Template != "" || p.conf.Merge != "" {
+		return []string{p.conf.ToDirectory + p.conf.ToFileName}
+	}
+	dirs := make(map[string]bool)
+	for cmid := range p.changes {
+		e := p.eMap[cmid]
+		for _, ent := range e.entry {
+			if dir, _, err := p.targetPath(e, ent); err == nil {
+				dirs[dir] = true
+			}
+		}
+	}
+	var paths []string
+	for dir := range dirs {
+		paths = append(paths, dir)
+	}
+	sort.Strings(paths)
+	return paths
+}
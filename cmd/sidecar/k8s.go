@@ -1,24 +1,29 @@
 package main
 
 import (
-	"fmt"
-	"io"
 	"io/ioutil"
-	"net"
-	"net/url"
 	"os"
-	"syscall"
-	"time"
+	"sync"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-func getClient(pathToConfig string) (*kubernetes.Clientset, error) {
+// getClient returns the clientset and the dynamic client for any other kind
+func getClient(pathToConfig string) (*kubernetes.Clientset, dynamic.Interface, error) {
 	var config *rest.Config
 	var err error
 	if _, err := os.Stat("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
@@ -30,9 +35,17 @@ func getClient(pathToConfig string) (*kubernetes.Clientset, error) {
 		}
 	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, nil, err
 	}
-	return kubernetes.NewForConfig(config)
+	return clientset, dynamicClient, nil
 }
 func getNamespace(ns string) string {
 	log.Debugf("namespace: %s", ns)
@@ -48,137 +61,261 @@ func getNamespace(ns string) string {
 
 }
 
-func watchConfigMap(clientset kubernetes.Clientset, namespace string, listOptions metav1.ListOptions, ev chan Event) {
-	for {
-		watcher, err := clientset.CoreV1().ConfigMaps(namespace).Watch(listOptions)
-		if err != nil {
-			switch err {
-			case io.EOF:
-				// watch closed normally
-			case io.ErrUnexpectedEOF:
-				log.Infof("Watch closed with unexpected EOF: %v", err)
-			default:
-				panic(fmt.Errorf("Failed to watch : %v", err))
-			}
-			// If this is "connection refused" error, it means that most likely apiserver is not responsive.
-			// It doesn't make sense to re-list all objects because most likely we will be able to restart
-			// watch where we ended.
-			// If that's the case wait and resend watch request.
-			if urlError, ok := err.(*url.Error); ok {
-				if opError, ok := urlError.Err.(*net.OpError); ok {
-					if errno, ok := opError.Err.(syscall.Errno); ok && errno == syscall.ECONNREFUSED {
-						time.Sleep(time.Second)
-						continue
-					}
-				}
-			}
-		}
-
-		for event := range watcher.ResultChan() {
+// sharedInformers runs one informer per kind/namespace, all pipelines watching the kind
+// share its list/watch and cache. The label selector and the other filters of a selector
+// are applied by its event handler. A field selector is given to the API server, a
+// selector with one gets its own informer per kind/namespace/fieldSelector.
+// Kinds other than ConfigMap and Secret are watched through the dynamic client,
+// their resources are found by discovery.
+type sharedInformers struct {
+	clientset kubernetes.Interface
+	dynamic   dynamic.Interface
+	mapper    *restmapper.DeferredDiscoveryRESTMapper
+	stopCh    <-chan struct{}
+	mu        sync.Mutex
+	informers map[string]cache.SharedIndexInformer
+}
 
-			cm := event.Object.(*v1.ConfigMap)
-			cmid := cm.Namespace + "/" + cm.GetName()
-			log.Debug(cmid)
-			for key, val := range cm.Labels {
-				log.Debugf("   Labels: %s=%s", key, val)
-			}
-			e := Event{}
-			e.cmid = cmid
-			e.namespace = cm.Namespace
-			switch event.Type {
-			case watch.Deleted:
-				e.action = "deleted"
-			case watch.Added:
-				e.action = "added"
-			case watch.Modified:
-				e.action = "modified"
-
-			default:
-				panic("unexpected event type " + event.Type)
-			}
-			var output []Entry
-			for dataKey, dataValue := range cm.Data {
-				log.Debugf("      dataKey: %s", dataKey)
-				var ent Entry
+func newSharedInformers(clientset kubernetes.Clientset, dynamicClient dynamic.Interface, stopCh <-chan struct{}) *sharedInformers {
+	return &sharedInformers{
+		clientset: &clientset,
+		dynamic:   dynamicClient,
+		mapper:    restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(clientset.Discovery())),
+		stopCh:    stopCh,
+		informers: make(map[string]cache.SharedIndexInformer),
+	}
+}
 
-				ent.data = string(dataValue)
-				ent.name = dataKey
-				output = append(output, ent)
+// subscribe sends every change of objects matching sel in namespace to ev.
+// The informer does a full list at startup, resumes the watch from the last
+// resourceVersion and relists on "410 Gone", so deletes done while the watch
+// was down are still delivered. A late subscriber gets "added" for every
+// object already in the cache. The informer is returned to wait for its initial list.
+func (s *sharedInformers) subscribe(namespace string, sel selector, ev chan Event) (cache.SharedIndexInformer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := sel.resource() + "/" + namespace
+	if sel.fieldSelector != "" {
+		key += "/" + sel.fieldSelector
+	}
+	informer, ok := s.informers[key]
+	if !ok {
+		var err error
+		w := sidecarHealth.watch(key)
+		informer, err = s.newInformer(namespace, sel, w)
+		if err != nil {
+			sidecarHealth.unwatch(w)
+			return nil, err
+		}
+		s.informers[key] = informer
+		informer.AddEventHandler(countEvents(key))
+		go informer.Run(s.stopCh)
+		go func() {
+			<-s.stopCh
+			sidecarHealth.unwatch(w)
+		}()
+	}
+	informer.AddEventHandler(eventHandler(ev, sel, s.stopCh))
+	return informer, nil
+}
 
-			}
-			e.entry = output
-			ev <- e
+// newInformer creates the informer of sel, the results of its list and watch calls go to w.
+func (s *sharedInformers) newInformer(namespace string, sel selector, w *watchState) (cache.SharedIndexInformer, error) {
+	clientset := s.clientset
+	switch sel.kind {
+	case config.KindConfigMap:
+		lw := &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.FieldSelector = sel.fieldSelector
+				return clientset.CoreV1().ConfigMaps(namespace).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.FieldSelector = sel.fieldSelector
+				return clientset.CoreV1().ConfigMaps(namespace).Watch(options)
+			},
+		}
+		return cache.NewSharedIndexInformer(sidecarHealth.trackWatch(w, lw), &v1.ConfigMap{}, 0, cache.Indexers{}), nil
+	case config.KindSecret:
+		lw := &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.FieldSelector = sel.fieldSelector
+				return clientset.CoreV1().Secrets(namespace).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.FieldSelector = sel.fieldSelector
+				return clientset.CoreV1().Secrets(namespace).Watch(options)
+			},
+		}
+		return cache.NewSharedIndexInformer(sidecarHealth.trackWatch(w, lw), &v1.Secret{}, 0, cache.Indexers{}), nil
+	}
+	return s.newDynamicInformer(namespace, sel, w)
+}
 
+// countEvents counts the notifications of the informer of the selector key
+func countEvents(key string) cache.ResourceEventHandlerFuncs {
+	count := func(obj interface{}, action string) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		kind := "unknown"
+		switch o := obj.(type) {
+		case *v1.ConfigMap:
+			kind = "ConfigMap"
+		case *v1.Secret:
+			kind = "Secret"
+		case *unstructured.Unstructured:
+			kind = o.GetKind()
 		}
+		sidecarWatchEvents.WithLabelValues(kind, action, key).Inc()
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { count(obj, "added") },
+		UpdateFunc: func(oldObj, newObj interface{}) { count(newObj, "modified") },
+		DeleteFunc: func(obj interface{}) { count(obj, "deleted") },
 	}
 }
 
-func watchSecret(clientset kubernetes.Clientset, namespace string, listOptions metav1.ListOptions, ev chan Event) {
-	for {
-		watcher, err := clientset.CoreV1().Secrets(namespace).Watch(listOptions)
-		if err != nil {
-			switch err {
-			case io.EOF:
-				// watch closed normally
-			case io.ErrUnexpectedEOF:
-				log.Infof("Watch for %v closed with unexpected EOF: %v", err)
-			default:
-				panic(fmt.Errorf("Failed to watch : %v", err))
+// eventHandler translates informer notifications to the Events of the objects passing
+// sel, sending stops once stopCh is closed. An update of an object that stops passing
+// sel is sent as "deleted".
+func eventHandler(ev chan Event, sel selector, stopCh <-chan struct{}) cache.ResourceEventHandlerFuncs {
+	send := func(e Event) {
+		select {
+		case ev <- e:
+		case <-stopCh:
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if e, ok := sel.toEvent(obj, "added"); ok {
+				send(e)
 			}
-			// If this is "connection refused" error, it means that most likely apiserver is not responsive.
-			// It doesn't make sense to re-list all objects because most likely we will be able to restart
-			// watch where we ended.
-			// If that's the case wait and resend watch request.
-			if urlError, ok := err.(*url.Error); ok {
-				if opError, ok := urlError.Err.(*net.OpError); ok {
-					if errno, ok := opError.Err.(syscall.Errno); ok && errno == syscall.ECONNREFUSED {
-						time.Sleep(time.Second)
-						continue
-					}
-				}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldMeta, err := meta.Accessor(oldObj)
+			if err != nil {
+				log.Error(err)
+				return
 			}
-		}
-
-		for event := range watcher.ResultChan() {
-
-			cm := event.Object.(*v1.Secret)
-			cmid := cm.Namespace + "/" + cm.GetName()
-			log.Debug(cmid)
-			for key, val := range cm.Labels {
-				log.Debugf("   Labels: %s=%s", key, val)
+			newMeta, err := meta.Accessor(newObj)
+			if err != nil {
+				log.Error(err)
+				return
 			}
-			e := Event{}
-			e.cmid = cmid
-			e.namespace = cm.Namespace
-			switch event.Type {
-			case watch.Deleted:
-				e.action = "deleted"
-			case watch.Added:
-				e.action = "added"
-			case watch.Modified:
-				e.action = "modified"
-
-			default:
-				panic("unexpected event type " + event.Type)
+			// periodic resync or relist without any change
+			if oldMeta.GetResourceVersion() == newMeta.GetResourceVersion() {
+				return
 			}
+			if e, ok := sel.toEvent(newObj, "modified"); ok {
+				send(e)
+			} else if e, ok := sel.toEvent(oldObj, "deleted"); ok {
+				send(e)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			// the delete was noticed only by a relist, the last known state is in the tombstone
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if e, ok := sel.toEvent(obj, "deleted"); ok {
+				send(e)
+			}
+		},
+	}
+}
 
-			var output []Entry
-			for dataKey, dataValue := range cm.Data {
-				log.Debugf("      dataKey: %s", dataKey)
-				var ent Entry
-
-				ent.data = string(dataValue)
-				ent.name = dataKey
-				output = append(output, ent)
+// list lists the current state of all objects matching sel, every
+// object is returned as a "modified" Event.
+func (s *sharedInformers) list(namespace string, sel selector) ([]Event, error) {
+	clientset := s.clientset
+	var objs []interface{}
+	options := metav1.ListOptions{LabelSelector: sel.labelSelector, FieldSelector: sel.fieldSelector}
+	switch sel.kind {
+	case config.KindConfigMap:
+		list, err := clientset.CoreV1().ConfigMaps(namespace).List(options)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			objs = append(objs, &list.Items[i])
+		}
+	case config.KindSecret:
+		list, err := clientset.CoreV1().Secrets(namespace).List(options)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			objs = append(objs, &list.Items[i])
+		}
+	default:
+		var err error
+		if objs, err = s.listDynamic(namespace, sel); err != nil {
+			return nil, err
+		}
+	}
 
-			}
-			e.entry = output
-			ev <- e
+	var events []Event
+	for _, obj := range objs {
+		if e, ok := sel.toEvent(obj, "modified"); ok {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
 
+func objectToEvent(obj interface{}, action string) (Event, bool) {
+	e := Event{}
+	e.action = action
+	var objMeta metav1.Object
+	e.apiVersion = "v1"
+	switch o := obj.(type) {
+	case *v1.ConfigMap:
+		objMeta = o
+		e.kind = "ConfigMap"
+		for dataKey, dataValue := range o.Data {
+			log.Debugf("      dataKey: %s", dataKey)
+			e.entry = append(e.entry, Entry{name: dataKey, data: []byte(dataValue)})
+		}
+		for dataKey, dataValue := range o.BinaryData {
+			log.Debugf("      binaryDataKey: %s", dataKey)
+			e.entry = append(e.entry, Entry{name: dataKey, data: dataValue})
+		}
+	case *v1.Secret:
+		objMeta = o
+		e.kind = "Secret"
+		for dataKey, dataValue := range o.Data {
+			log.Debugf("      dataKey: %s", dataKey)
+			e.entry = append(e.entry, Entry{name: dataKey, data: dataValue})
 		}
+	case *unstructured.Unstructured:
+		objMeta = o
+		e.apiVersion = o.GetAPIVersion()
+		e.kind = o.GetKind()
+		e.object = o.Object
+		e.entry = unstructuredEntries(o)
+	default:
+		log.Errorf("unexpected object type %T", obj)
+		return e, false
 	}
+	// ConfigMaps and Secrets keep namespace/name, other kinds may share names with them
+	e.cmid = objMeta.GetNamespace() + "/" + objMeta.GetName()
+	if e.object != nil {
+		e.cmid = objMeta.GetNamespace() + "/" + e.kind + "/" + objMeta.GetName()
+	}
+	e.namespace = objMeta.GetNamespace()
+	e.name = objMeta.GetName()
+	e.uid = string(objMeta.GetUID())
+	e.labels = objMeta.GetLabels()
+	e.annotations = objMeta.GetAnnotations()
+	e.resourceVersion = objMeta.GetResourceVersion()
+	log.Debug(e.cmid)
+	for key, val := range objMeta.GetLabels() {
+		log.Debugf("   Labels: %s=%s", key, val)
+	}
+	return e, true
 }
-func writeToSecret(clientset kubernetes.Clientset, ns string, name string, stringData map[string]string) {
+
+func writeToSecret(clientset kubernetes.Clientset, ns string, name string, stringData map[string]string) error {
 
 	_, err := clientset.CoreV1().Secrets(ns).Get(name, metav1.GetOptions{})
 	if err == nil {
@@ -190,10 +327,10 @@ func writeToSecret(clientset kubernetes.Clientset, ns string, name string, strin
 		})
 		if err != nil {
 			log.Error(err)
-			return
+			return err
 		}
 		log.Infof("Updated Secret: %s/%s", ns, name)
-		return
+		return nil
 	}
 
 	_, err = clientset.CoreV1().Secrets(ns).Create(&v1.Secret{
@@ -204,15 +341,15 @@ func writeToSecret(clientset kubernetes.Clientset, ns string, name string, strin
 	})
 	if err != nil {
 		log.Error(err)
-		return
+		return err
 	}
 	log.Infof("Created Secret: %s/%s", ns, name)
 
-	return
+	return nil
 
 }
 
-func writeToConfigMap(clientset kubernetes.Clientset, ns string, name string, stringData map[string]string) {
+func writeToConfigMap(clientset kubernetes.Clientset, ns string, name string, stringData map[string]string) error {
 
 	_, err := clientset.CoreV1().ConfigMaps(ns).Get(name, metav1.GetOptions{})
 	if err == nil {
@@ -224,10 +361,10 @@ func writeToConfigMap(clientset kubernetes.Clientset, ns string, name string, st
 		})
 		if err != nil {
 			log.Error(err)
-			return
+			return err
 		}
 		log.Infof("Updated ConfigMap: %s/%s", ns, name)
-		return
+		return nil
 	}
 
 	_, err = clientset.CoreV1().ConfigMaps(ns).Create(&v1.ConfigMap{
@@ -238,9 +375,9 @@ func writeToConfigMap(clientset kubernetes.Clientset, ns string, name string, st
 	})
 	if err != nil {
 		log.Error(err)
-		return
+		return err
 	}
 	log.Infof("Created ConfigMap: %s/%s", ns, name)
-	return
+	return nil
 
 }
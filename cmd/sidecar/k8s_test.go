@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func labeledConfigMap(name string, labels map[string]string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, ResourceVersion: "1", Labels: labels},
+		Data:       map[string]string{"a.conf": name},
+	}
+}
+
+// testInformers returns sharedInformers over a fake clientset holding objs
+func testInformers(stopCh <-chan struct{}, objs ...runtime.Object) *sharedInformers {
+	return &sharedInformers{
+		clientset: fake.NewSimpleClientset(objs...),
+		stopCh:    stopCh,
+		informers: make(map[string]cache.SharedIndexInformer),
+	}
+}
+
+// receive returns the names of the first n events of ev
+func receive(t *testing.T, ev chan Event, n int) []string {
+	t.Helper()
+	var names []string
+	for len(names) < n {
+		select {
+		case e := <-ev:
+			names = append(names, e.name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v, want %d events", names, n)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSubscribeSharesInformerOfKind(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	s := testInformers(stopCh,
+		labeledConfigMap("a1", map[string]string{"app": "a"}),
+		labeledConfigMap("a2", map[string]string{"app": "a"}),
+		labeledConfigMap("b1", map[string]string{"app": "b"}),
+	)
+	tests := []struct {
+		labelSelector string
+		want          []string
+	}{
+		{labelSelector: "app=a", want: []string{"a1", "a2"}},
+		{labelSelector: "app=b", want: []string{"b1"}},
+		{labelSelector: "", want: []string{"a1", "a2", "b1"}},
+	}
+	var informers []cache.SharedIndexInformer
+	for _, tt := range tests {
+		sel, err := parseSelector(config.Selector{Kind: config.KindConfigMap, LabelSelector: tt.labelSelector})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev := make(chan Event)
+		informer, err := s.subscribe("default", sel, ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		informers = append(informers, informer)
+		got := receive(t, ev, len(tt.want))
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("selector %q: events %v, want %v", tt.labelSelector, got, tt.want)
+				break
+			}
+		}
+	}
+	if len(s.informers) != 1 {
+		t.Errorf("%d informers, want one for all label selectors", len(s.informers))
+	}
+	for _, informer := range informers[1:] {
+		if informer != informers[0] {
+			t.Error("selectors of the same kind got different informers")
+		}
+	}
+
+	// a field selector must go to the API server, it gets its own informer
+	sel, err := parseSelector(config.Selector{Kind: config.KindConfigMap, FieldSelector: "metadata.name=a1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.subscribe("default", sel, make(chan Event, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.informers) != 2 {
+		t.Errorf("%d informers, want a second one for the field selector", len(s.informers))
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lastGood is the last output that was valid and reloaded successfully
+type lastGood struct {
+	Output  string            `json:"output"`
+	Sources map[string]string `json:"sources"` // cmid -> resourceVersion
+	Secret  bool              `json:"secret"`  // data of Secrets in Output
+	Time    time.Time         `json:"time"`
+}
+
+func (p *pipeline) lastGoodFile() string {
+	return filepath.Join(p.conf.LastGoodDirectory, p.conf.Name+".lastgood.json")
+}
+
+func (p *pipeline) loadLastGood() (*lastGood, error) {
+	content, err := ioutil.ReadFile(p.lastGoodFile())
+	if err != nil {
+		return nil, err
+	}
+	state := &lastGood{}
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// sourceVersions returns cmid -> resourceVersion of the sources of the output
+func (p *pipeline) sourceVersions() map[string]string {
+	versions := make(map[string]string)
+	for cmid, e := range p.eMap {
+		if _, excluded := p.excluded[cmid]; !excluded && e.action != "deleted" {
+			versions[cmid] = e.resourceVersion
+		}
+	}
+	return versions
+}
+
+// saveLastGood remembers out together with the sources that produced it,
+// a failed write keeps the previous last good output. The file is readable
+// by the owner only, out may contain data of Secrets.
+func (p *pipeline) saveLastGood(out string) {
+	state := lastGood{Output: out, Sources: p.sourceVersions(), Secret: p.hasSecretSources(), Time: time.Now()}
+	content, err := json.Marshal(state)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	createDir(p.conf.LastGoodDirectory)
+	if err := writeToFile(p.lastGoodFile(), content, 0600); err != nil {
+		log.Warnf("Pipeline %s: last good output not saved: %v", p.conf.Name, err)
+	}
+}
+
+// restoreLastGood writes the last good output at startup, before the first
+// watch event, unless the output is already there
+func (p *pipeline) restoreLastGood(ctx context.Context) {
+	state, err := p.loadLastGood()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Pipeline %s: last good output not restored: %v", p.conf.Name, err)
+		}
+		return
+	}
+	p.restored = state.Sources
+	current, err := ioutil.ReadFile(p.conf.ToDirectory + p.conf.ToFileName)
+	if err == nil && string(current) == state.Output {
+		p.lastOut = state.Output
+		return
+	}
+	log.Infof("Pipeline %s: restoring last good output from %s (%d sources)", p.conf.Name, state.Time, len(state.Sources))
+	if err := p.writeOutput(state.Output, state.Secret); err != nil {
+		log.Warnf("Pipeline %s: last good output not restored: %v", p.conf.Name, err)
+		return
+	}
+	p.lastOut = state.Output
+	p.reload(ctx)
+}
+
+// rollback writes the last good output again after a failed reload or PostWriteCommands of a new one
+func (p *pipeline) rollback(ctx context.Context) {
+	state, err := p.loadLastGood()
+	if err != nil {
+		log.Errorf("Pipeline %s: no last good output to roll back to: %v", p.conf.Name, err)
+		return
+	}
+	if state.Output == p.lastOut {
+		log.Errorf("Pipeline %s: the last good output failed", p.conf.Name)
+		return
+	}
+	log.Warnf("Pipeline %s: rolling back to last good output from %s", p.conf.Name, state.Time)
+	sidecarRollbacks.WithLabelValues(p.conf.Name).Inc()
+	if err := p.writeOutput(state.Output, state.Secret); err != nil {
+		log.Errorf("Pipeline %s: rollback not written: %v", p.conf.Name, err)
+		return
+	}
+	p.lastOut = state.Output
+	p.runHooks(ctx, p.conf.PostWriteCommands, p.hookEnv("rollback"))
+	if !p.reload(ctx) {
+		log.Errorf("Pipeline %s: reload after rollback failed", p.conf.Name)
+	}
+}
+
+// checkRestored compares the synced sources with the sources of the restored
+// last good output, the first render replaces the output when they differ
+func (p *pipeline) checkRestored() {
+	if p.restored == nil {
+		return
+	}
+	current := p.sourceVersions()
+	var changed []string
+	for cmid, rv := range current {
+		if p.restored[cmid] != rv {
+			changed = append(changed, cmid)
+		}
+	}
+	for cmid := range p.restored {
+		if _, ok := current[cmid]; !ok {
+			changed = append(changed, cmid)
+		}
+	}
+	if len(changed) == 0 {
+		log.Infof("Pipeline %s: the restored last good output is up to date with its %d sources", p.conf.Name, len(current))
+	} else {
+		sort.Strings(changed)
+		log.Infof("Pipeline %s: sources changed since the restored last good output: %s", p.conf.Name, strings.Join(changed, ", "))
+	}
+	p.restored = nil
+}
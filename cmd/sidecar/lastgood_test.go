@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSaveLastGoodSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lastgood")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := testPipeline(t, mergeJSONConfig)
+	p.conf.LastGoodDirectory = dir
+	p.apply(testEvent("ns", "a", "1", map[string]string{"a.json": `{"a": 1}`}))
+	p.apply(testEvent("ns", "b", "7", map[string]string{"a.json": `{"b": 1}`}))
+	p.apply(testEvent("ns", "c", "3", map[string]string{"a.json": `{`}))
+	p.excluded["ns/c"] = "3"
+
+	p.saveLastGood(`{"a": 1, "b": 1}`)
+	state, err := p.loadLastGood()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"ns/a": "1", "ns/b": "7"}; !reflect.DeepEqual(state.Sources, want) {
+		t.Errorf("sources %v, want %v", state.Sources, want)
+	}
+	if state.Output != `{"a": 1, "b": 1}` {
+		t.Errorf("output %q", state.Output)
+	}
+}
+
+func TestSaveLastGoodSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lastgood")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name   string
+		kinds  []string
+		secret bool
+	}{
+		{name: "ConfigMaps", kinds: []string{"ConfigMap", "ConfigMap"}},
+		{name: "a Secret", kinds: []string{"ConfigMap", "Secret"}, secret: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testPipeline(t, mergeJSONConfig)
+			p.conf.LastGoodDirectory = dir
+			for i, kind := range tt.kinds {
+				e := testEvent("ns", string(rune('a'+i)), "1", map[string]string{"a.json": "{}"})
+				e.kind = kind
+				p.apply(e)
+			}
+			p.saveLastGood("{}")
+			state, err := p.loadLastGood()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state.Secret != tt.secret {
+				t.Errorf("secret %v, want %v", state.Secret, tt.secret)
+			}
+			fi, err := os.Stat(p.lastGoodFile())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0600 {
+				t.Errorf("last good file mode %o, want 0600", fi.Mode().Perm())
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+
+	"gopkg.in/yaml.v2"
+)
+
+// merger deep-merges documents of more sources and remembers which source set
+// which value, so a conflict can name both sources.
+type merger struct {
+	listStrategy string
+	listKeys     map[string]string // list path (receivers, route.routes[].routes) -> item key
+	origins      map[string]string // value path -> cmid
+}
+
+func newMerger(myConfig config.Pipeline) *merger {
+	m := &merger{
+		listStrategy: myConfig.MergeListStrategy,
+		listKeys:     make(map[string]string),
+		origins:      make(map[string]string),
+	}
+	for _, byKey := range myConfig.MergeByKey {
+		i := strings.LastIndex(byKey, "[].")
+		m.listKeys[byKey[:i]] = byKey[i+len("[]."):]
+	}
+	return m
+}
+
+// mergeOutput parses the data keys matching MergeKeys of all sources (in SortBy
+// order) and deep-merges them into one document. A source that conflicts with
+// the already merged ones is reported in the error.
+func mergeOutput(myConfig config.Pipeline, sources []Source) (string, error) {
+	m := newMerger(myConfig)
+	var doc interface{}
+	for _, source := range sources {
+		cmid := source.cmid
+		var keys []string
+		for key := range source.Data {
+			if matchAny(myConfig.MergeKeys, key) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			part, err := parseDocument(myConfig.Merge, source.Data[key])
+			if err == nil {
+				doc, err = m.merge(doc, part, "", "", cmid)
+			}
+			if err != nil {
+				log.Warnf("Merge of %s key %s failed: %v", cmid, key, err)
+				return "", fmt.Errorf("merge of %s key %s: %v", cmid, key, err)
+			}
+		}
+	}
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+
+	var out []byte
+	var err error
+	if myConfig.Merge == "json" {
+		out, err = json.MarshalIndent(doc, "", "  ")
+	} else {
+		out, err = yaml.Marshal(doc)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// merge merges src of cmid into dst. displayPath identifies the value in messages,
+// schemaPath (list items as []) selects the list strategy.
+func (m *merger) merge(dst, src interface{}, displayPath, schemaPath, cmid string) (interface{}, error) {
+	if dst == nil {
+		m.origins[displayPath] = cmid
+		return src, nil
+	}
+	if src == nil {
+		return dst, nil
+	}
+	switch s := src.(type) {
+	case map[string]interface{}:
+		d, ok := dst.(map[string]interface{})
+		if !ok {
+			return nil, m.conflict(displayPath, cmid)
+		}
+		for k, v := range s {
+			merged, err := m.merge(d[k], v, joinPath(displayPath, k), joinPath(schemaPath, k), cmid)
+			if err != nil {
+				return nil, err
+			}
+			d[k] = merged
+		}
+		return d, nil
+	case []interface{}:
+		d, ok := dst.([]interface{})
+		if !ok {
+			return nil, m.conflict(displayPath, cmid)
+		}
+		if key, ok := m.listKeys[schemaPath]; ok {
+			return m.mergeByKey(d, s, key, displayPath, schemaPath, cmid)
+		}
+		if m.listStrategy == "replace" {
+			m.origins[displayPath] = cmid
+			return s, nil
+		}
+		return append(d, s...), nil
+	default:
+		if !reflect.DeepEqual(dst, src) {
+			return nil, m.conflict(displayPath, cmid)
+		}
+		return dst, nil
+	}
+}
+
+// mergeByKey merges list items with the same value of key, other items are appended
+func (m *merger) mergeByKey(dst, src []interface{}, key, displayPath, schemaPath, cmid string) (interface{}, error) {
+	for _, item := range src {
+		itemMap, ok := item.(map[string]interface{})
+		if !ok || itemMap[key] == nil {
+			dst = append(dst, item)
+			continue
+		}
+		id := fmt.Sprint(itemMap[key])
+		itemPath := fmt.Sprintf("%s[%s=%s]", displayPath, key, id)
+		found := false
+		for i, existing := range dst {
+			existingMap, ok := existing.(map[string]interface{})
+			if !ok || fmt.Sprint(existingMap[key]) != id {
+				continue
+			}
+			merged, err := m.merge(existingMap, itemMap, itemPath, schemaPath+"[]", cmid)
+			if err != nil {
+				return nil, err
+			}
+			dst[i] = merged
+			found = true
+			break
+		}
+		if !found {
+			m.origins[itemPath] = cmid
+			dst = append(dst, item)
+		}
+	}
+	return dst, nil
+}
+
+// conflict reports the value at displayPath set by another source than cmid
+func (m *merger) conflict(displayPath, cmid string) error {
+	for p := displayPath; ; p = parentPath(p) {
+		if origin, ok := m.origins[p]; ok {
+			return fmt.Errorf("conflict at %q, value already set by %s", displayPath, origin)
+		}
+		if p == "" {
+			return fmt.Errorf("conflict at %q", displayPath)
+		}
+	}
+}
+
+func joinPath(p, key string) string {
+	if p == "" {
+		return key
+	}
+	return p + "." + key
+}
+
+func parentPath(p string) string {
+	i := strings.LastIndexAny(p, ".[")
+	if i < 0 {
+		return ""
+	}
+	return p[:i]
+}
+
+// parseDocument parses data as yaml or json and converts yaml maps to map[string]interface{}
+func parseDocument(format, data string) (interface{}, error) {
+	var doc interface{}
+	if format == "json" {
+		if err := json.Unmarshal([]byte(data), &doc); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+	if err := yaml.Unmarshal([]byte(data), &doc); err != nil {
+		return nil, err
+	}
+	return normalizeYaml(doc), nil
+}
+
+func normalizeYaml(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[fmt.Sprint(k)] = normalizeYaml(val)
+		}
+		return m
+	case []interface{}:
+		for i := range t {
+			t[i] = normalizeYaml(t[i])
+		}
+		return t
+	}
+	return v
+}
+
+// matchAny reports whether name matches any of the glob patterns, no patterns match everything
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
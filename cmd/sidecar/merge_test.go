@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+)
+
+func mergeSources(data ...string) []Source {
+	var sources []Source
+	for i, d := range data {
+		name := string(rune('a' + i))
+		sources = append(sources, Source{cmid: "default/" + name, Namespace: "default", Name: name, Data: map[string]string{"part.json": d}})
+	}
+	return sources
+}
+
+func TestMergeOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		byKey    []string
+		sources  []Source
+		want     string // compact json
+		conflict string // part of the error
+	}{
+		{
+			name:    "maps",
+			sources: mergeSources(`{"a": {"x": 1}}`, `{"a": {"y": 2}, "b": true}`),
+			want:    `{"a":{"x":1,"y":2},"b":true}`,
+		},
+		{
+			name:    "equal values",
+			sources: mergeSources(`{"a": 1}`, `{"a": 1}`),
+			want:    `{"a":1}`,
+		},
+		{
+			name:    "append lists",
+			sources: mergeSources(`{"l": [1, 2]}`, `{"l": [3]}`),
+			want:    `{"l":[1,2,3]}`,
+		},
+		{
+			name:     "replace lists",
+			strategy: "replace",
+			sources:  mergeSources(`{"l": [1, 2]}`, `{"l": [3]}`),
+			want:     `{"l":[3]}`,
+		},
+		{
+			name:    "lists by key",
+			byKey:   []string{"receivers[].name"},
+			sources: mergeSources(`{"receivers": [{"name": "a", "x": 1}]}`, `{"receivers": [{"name": "a", "y": 2}, {"name": "b"}]}`),
+			want:    `{"receivers":[{"name":"a","x":1,"y":2},{"name":"b"}]}`,
+		},
+		{
+			name:    "items of an unkeyed list are appended",
+			byKey:   []string{"route.routes[].routes[].receiver"},
+			sources: mergeSources(`{"route": {"routes": [{"routes": [{"receiver": "a", "x": 1}]}]}}`, `{"route": {"routes": [{"routes": [{"receiver": "a", "y": 2}]}]}}`),
+			want:    `{"route":{"routes":[{"routes":[{"receiver":"a","x":1}]},{"routes":[{"receiver":"a","y":2}]}]}}`,
+		},
+		{
+			name:     "conflicting values",
+			sources:  mergeSources(`{"a": {"x": 1}}`, `{"a": {"x": 2}}`),
+			conflict: `conflict at "a.x", value already set by default/a`,
+		},
+		{
+			name:     "conflicting types",
+			sources:  mergeSources(`{"a": {"x": 1}}`, `{"a": [1]}`),
+			conflict: `conflict at "a", value already set by default/a`,
+		},
+		{
+			name:     "conflict in a list item by key",
+			byKey:    []string{"receivers[].name"},
+			sources:  mergeSources(`{"receivers": [{"name": "a", "x": 1}]}`, `{"receivers": [{"name": "a", "x": 2}]}`),
+			conflict: `conflict at "receivers[name=a].x", value already set by default/a`,
+		},
+		{
+			name:     "wrong document",
+			sources:  mergeSources(`{"a": 1}`, `{`),
+			conflict: "merge of default/b key part.json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := config.Pipeline{Merge: "json", MergeListStrategy: tt.strategy, MergeByKey: tt.byKey}
+			out, err := mergeOutput(conf, tt.sources)
+			if tt.conflict != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.conflict) {
+					t.Fatalf("error %v, want %q", err, tt.conflict)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := strings.NewReplacer(" ", "", "\n", "").Replace(out)
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeOutputYaml(t *testing.T) {
+	conf := config.Pipeline{Merge: "yaml", MergeKeys: []string{"*.yaml"}}
+	sources := []Source{
+		{cmid: "default/a", Data: map[string]string{"a.yaml": "a:\n  x: 1\n", "a.txt": "not merged"}},
+		{cmid: "default/b", Data: map[string]string{"b.yaml": "a:\n  z: 2\n"}},
+	}
+	out, err := mergeOutput(conf, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a:\n  x: 1\n  z: 2\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// namespaceFilter limits the sources of a pipeline to the namespaces matching
+// IncludeNamespaces, not matching ExcludeNamespaces and labelled by NamespaceSelector.
+// Cluster scoped sources are not filtered.
+type namespaceFilter struct {
+	include  []string
+	exclude  []string
+	selector string
+	informer cache.SharedIndexInformer // namespaces matching selector, nil without selector
+}
+
+// newNamespaceFilter returns nil when the pipeline does not filter namespaces
+func newNamespaceFilter(conf config.Pipeline) (*namespaceFilter, error) {
+	if conf.NamespaceSelector == "" && len(conf.IncludeNamespaces) == 0 && len(conf.ExcludeNamespaces) == 0 {
+		return nil, nil
+	}
+	if _, err := labels.Parse(conf.NamespaceSelector); err != nil {
+		return nil, fmt.Errorf("wrong NamespaceSelector: %v", err)
+	}
+	return &namespaceFilter{
+		include:  conf.IncludeNamespaces,
+		exclude:  conf.ExcludeNamespaces,
+		selector: conf.NamespaceSelector,
+	}, nil
+}
+
+func (f *namespaceFilter) allowed(namespace string) bool {
+	if f == nil || namespace == "" {
+		return true
+	}
+	if !matchAny(f.include, namespace) {
+		return false
+	}
+	if len(f.exclude) > 0 && matchAny(f.exclude, namespace) {
+		return false
+	}
+	if f.informer != nil {
+		_, exists, err := f.informer.GetStore().GetByKey(namespace)
+		return err == nil && exists
+	}
+	return true
+}
+
+// subscribeNamespaces watches the namespaces matching labelSelector, every change of
+// the set is signalled on changed without blocking.
+func (s *sharedInformers) subscribeNamespaces(labelSelector string, changed chan struct{}) (cache.SharedIndexInformer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := "namespace//" + labelSelector
+	informer, ok := s.informers[key]
+	if !ok {
+		clientset := s.clientset
+		w := sidecarHealth.watch(key)
+		lw := &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = labelSelector
+				return clientset.CoreV1().Namespaces().List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = labelSelector
+				return clientset.CoreV1().Namespaces().Watch(options)
+			},
+		}
+		informer = cache.NewSharedIndexInformer(sidecarHealth.trackWatch(w, lw), &v1.Namespace{}, 0, cache.Indexers{})
+		s.informers[key] = informer
+		go informer.Run(s.stopCh)
+		go func() {
+			<-s.stopCh
+			sidecarHealth.unwatch(w)
+		}()
+	}
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { notify() },
+		UpdateFunc: func(oldObj, newObj interface{}) {},
+		DeleteFunc: func(obj interface{}) { notify() },
+	})
+	return informer, nil
+}
+
+// refilter applies a changed set of namespaces: sources of namespaces that are
+// not allowed anymore are deleted, sources of newly allowed ones are added from
+// the caches of the informers of p.selectors. Returns the number of changes.
+func (p *pipeline) refilter(informers []cache.SharedIndexInformer) int {
+	n := 0
+	for _, e := range p.eMap {
+		if e.action != "deleted" && !p.namespaces.allowed(e.namespace) && p.apply(e) {
+			n++
+		}
+	}
+	for i, sel := range p.selectors {
+		for _, obj := range informers[i].GetStore().List() {
+			if e, ok := sel.toEvent(obj, "added"); ok && p.apply(e) {
+				n++
+			}
+		}
+	}
+	if n > 0 {
+		log.Infof("Pipeline %s: namespaces changed, %d sources added or removed", p.conf.Name, n)
+	}
+	return n
+}
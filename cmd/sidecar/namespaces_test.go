@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestNamespaceFilterAllowed(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     config.Pipeline
+		selected []string // namespaces matching the NamespaceSelector
+		allowed  map[string]bool
+	}{
+		{
+			name:    "no filter",
+			allowed: map[string]bool{"default": true, "kube-system": true},
+		},
+		{
+			name:    "include",
+			conf:    config.Pipeline{IncludeNamespaces: []string{"team-*", "default"}},
+			allowed: map[string]bool{"default": true, "team-a": true, "kube-system": false, "": true},
+		},
+		{
+			name:    "exclude",
+			conf:    config.Pipeline{ExcludeNamespaces: []string{"kube-*"}},
+			allowed: map[string]bool{"default": true, "kube-system": false, "kube-public": false},
+		},
+		{
+			name:    "include and exclude",
+			conf:    config.Pipeline{IncludeNamespaces: []string{"team-*"}, ExcludeNamespaces: []string{"team-old"}},
+			allowed: map[string]bool{"team-a": true, "team-old": false, "default": false},
+		},
+		{
+			name:     "selector",
+			conf:     config.Pipeline{NamespaceSelector: "grafana=true", ExcludeNamespaces: []string{"team-old"}},
+			selected: []string{"team-a", "team-old"},
+			allowed:  map[string]bool{"team-a": true, "team-old": false, "team-b": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newNamespaceFilter(tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.conf.NamespaceSelector != "" {
+				// the namespace informer is not run, its store holds the selected namespaces
+				f.informer = cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1.Namespace{}, 0, cache.Indexers{})
+				for _, name := range tt.selected {
+					if err := f.informer.GetStore().Add(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			for namespace, want := range tt.allowed {
+				if got := f.allowed(namespace); got != want {
+					t.Errorf("allowed(%q) = %v, want %v", namespace, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewNamespaceFilter(t *testing.T) {
+	if f, err := newNamespaceFilter(config.Pipeline{}); f != nil || err != nil {
+		t.Errorf("filter %v, error %v without namespace options, want none", f, err)
+	}
+	if _, err := newNamespaceFilter(config.Pipeline{NamespaceSelector: "a in (b"}); err == nil {
+		t.Error("wrong NamespaceSelector accepted")
+	}
+}
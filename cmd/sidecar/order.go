@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sortSources orders sources by the sortBy keys, the first key that differs wins.
+// Keys are priority (lower first, missing = 0), namespace, name, kind,
+// label:<name> and annotation:<name>. Sources equal in all keys are ordered
+// by namespace/name, so the order is always stable.
+func sortSources(sources []Source, sortBy []string) {
+	sort.SliceStable(sources, func(i, j int) bool {
+		for _, key := range sortBy {
+			if c := compareSources(sources[i], sources[j], key); c != 0 {
+				return c < 0
+			}
+		}
+		if sources[i].Namespace != sources[j].Namespace {
+			return sources[i].Namespace < sources[j].Namespace
+		}
+		return sources[i].Name < sources[j].Name
+	})
+}
+
+func compareSources(a, b Source, key string) int {
+	switch {
+	case key == "priority":
+		switch {
+		case a.Priority < b.Priority:
+			return -1
+		case a.Priority > b.Priority:
+			return 1
+		}
+		return 0
+	case key == "namespace":
+		return strings.Compare(a.Namespace, b.Namespace)
+	case key == "name":
+		return strings.Compare(a.Name, b.Name)
+	case key == "kind":
+		return strings.Compare(a.Kind, b.Kind)
+	case strings.HasPrefix(key, "label:"):
+		name := strings.TrimPrefix(key, "label:")
+		return strings.Compare(a.Labels[name], b.Labels[name])
+	case strings.HasPrefix(key, "annotation:"):
+		name := strings.TrimPrefix(key, "annotation:")
+		return strings.Compare(a.Annotations[name], b.Annotations[name])
+	}
+	return 0
+}
+
+// sourcePriority reads priorityKey from annotations, then from labels
+func sourcePriority(e Event, priorityKey string) int {
+	value, ok := e.annotations[priorityKey]
+	if !ok {
+		value, ok = e.labels[priorityKey]
+	}
+	if !ok {
+		return 0
+	}
+	priority, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		log.Warnf("Wrong %s %q on %s: %v", priorityKey, value, e.cmid, err)
+		return 0
+	}
+	return priority
+}
+
+// sourceFuncs returns template functions iterating sources in their order
+func sourceFuncs(sources []Source) map[string]interface{} {
+	return map[string]interface{}{
+		// all sources
+		"sources": func() []Source {
+			return sources
+		},
+		// sources with the data key
+		"sourcesWithKey": func(key string) []Source {
+			var out []Source
+			for _, source := range sources {
+				if _, ok := source.Data[key]; ok {
+					out = append(out, source)
+				}
+			}
+			return out
+		},
+		// content of the data key of all sources having it
+		"values": func(key string) []string {
+			var out []string
+			for _, source := range sources {
+				if value, ok := source.Data[key]; ok {
+					out = append(out, value)
+				}
+			}
+			return out
+		},
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSortSources(t *testing.T) {
+	sources := []Source{
+		{Namespace: "b", Name: "x", Kind: "ConfigMap", Priority: 10, Labels: map[string]string{"tier": "2"}},
+		{Namespace: "a", Name: "y", Kind: "Secret", Priority: -5, Annotations: map[string]string{"order": "1"}},
+		{Namespace: "a", Name: "x", Kind: "ConfigMap", Priority: 10, Labels: map[string]string{"tier": "1"}},
+		{Namespace: "c", Name: "z", Kind: "ConfigMap"},
+	}
+	tests := []struct {
+		name   string
+		sortBy []string
+		want   []string // namespace/name
+	}{
+		{name: "default namespace/name", want: []string{"a/x", "a/y", "b/x", "c/z"}},
+		{name: "priority", sortBy: []string{"priority"}, want: []string{"a/y", "c/z", "a/x", "b/x"}},
+		{name: "name then namespace", sortBy: []string{"name", "namespace"}, want: []string{"a/x", "b/x", "a/y", "c/z"}},
+		{name: "kind", sortBy: []string{"kind"}, want: []string{"a/x", "b/x", "c/z", "a/y"}},
+		{name: "label, missing first", sortBy: []string{"label:tier"}, want: []string{"a/y", "c/z", "a/x", "b/x"}},
+		{name: "annotation", sortBy: []string{"annotation:order"}, want: []string{"a/x", "b/x", "c/z", "a/y"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sorted := append([]Source(nil), sources...)
+			sortSources(sorted, tt.sortBy)
+			var got []string
+			for _, s := range sorted {
+				got = append(got, s.Namespace+"/"+s.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("order %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortSourcesExtremePriorities(t *testing.T) {
+	const maxInt = int(^uint(0) >> 1)
+	sources := []Source{
+		{Namespace: "a", Name: "max", Priority: maxInt},
+		{Namespace: "a", Name: "min", Priority: -maxInt - 1},
+		{Namespace: "a", Name: "zero"},
+	}
+	sortSources(sources, []string{"priority"})
+	var got []string
+	for _, s := range sources {
+		got = append(got, s.Name)
+	}
+	if want := []string{"min", "zero", "max"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order %v, want %v", got, want)
+	}
+}
+
+func TestSourcePriority(t *testing.T) {
+	const key = "k8s-sidecar/priority"
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		labels      map[string]string
+		want        int
+	}{
+		{name: "missing", want: 0},
+		{name: "annotation", annotations: map[string]string{key: "10"}, want: 10},
+		{name: "label", labels: map[string]string{key: "-3"}, want: -3},
+		{name: "annotation before label", annotations: map[string]string{key: " 7 "}, labels: map[string]string{key: "3"}, want: 7},
+		{name: "not a number", annotations: map[string]string{key: "high"}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := testEvent("default", "a", "1", nil)
+			e.annotations, e.labels = tt.annotations, tt.labels
+			if got := sourcePriority(e, key); got != tt.want {
+				t.Errorf("sourcePriority = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/template"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// pipeline is the runtime state of one config.Pipeline
+type pipeline struct {
+	conf       config.Pipeline
+	clientset  kubernetes.Clientset
+	namespace  string // namespace of the sources, "" for all
+	namespaces *namespaceFilter
+	nsChanged  chan struct{} // the set of namespaces of NamespaceSelector changed
+	selectors  []selector
+	events     chan Event
+	eMap       map[string]Event
+	lastOut    string
+	restored   map[string]string          // cmid -> resourceVersion of the restored last good output
+	lastDirs   map[string]bool            // directories written in the symlink WriteMode
+	files      map[string]map[string]bool // files written per source in the rename WriteMode
+	excluded   map[string]string          // cmid -> resourceVersion of sources breaking the output
+	candidates string                     // cmid@resourceVersion of all sources of the last validation
+	reporter   *reporter
+	once       bool              // render once and exit, nothing to reload
+	grace      time.Duration     // ShutdownGracePeriod of the render in flight
+	changes    map[string]string // cmid -> action of the changes since the last render
+}
+
+func newPipeline(clientset kubernetes.Clientset, conf config.Pipeline, reporter *reporter, once bool) (*pipeline, error) {
+	p := &pipeline{
+		once:      once,
+		conf:      conf,
+		clientset: clientset,
+		reporter:  reporter,
+		events:    make(chan Event),
+		eMap:      make(map[string]Event),
+		lastDirs:  make(map[string]bool),
+		files:     make(map[string]map[string]bool),
+		excluded:  make(map[string]string),
+		changes:   make(map[string]string),
+		nsChanged: make(chan struct{}, 1),
+		grace:     defaultShutdownGrace,
+	}
+	var err error
+	if p.namespaces, err = newNamespaceFilter(conf); err != nil {
+		return nil, err
+	}
+	if conf.FromNamespace != "ALL" && p.namespaces == nil {
+		p.namespace = getNamespace(conf.FromNamespace)
+	}
+	for _, sel := range conf.Selectors {
+		parsed, err := parseSelector(sel)
+		if err != nil {
+			return nil, err
+		}
+		p.selectors = append(p.selectors, parsed)
+	}
+	tmpl := template.Init().Funcs(sourceFuncs(nil))
+	if err := tmpl.Check(conf.Template); err != nil {
+		return nil, fmt.Errorf("wrong Template: %v", err)
+	}
+	if err := tmpl.Check(conf.ToDirectory); err != nil {
+		return nil, fmt.Errorf("wrong ToDirectory: %v", err)
+	}
+	return p, nil
+}
+
+// newPipelines creates all pipelines of conf, the error names the first one that cannot be created
+func newPipelines(clientset kubernetes.Clientset, conf config.Config, reporter *reporter, once bool) ([]*pipeline, error) {
+	var pipelines []*pipeline
+	for _, pipelineConf := range conf.AllPipelines() {
+		p, err := newPipeline(clientset, pipelineConf, reporter, once)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: %v", pipelineConf.Name, err)
+		}
+		if conf.ShutdownGracePeriod > 0 {
+			p.grace = conf.ShutdownGracePeriod
+		}
+		pipelines = append(pipelines, p)
+	}
+	return pipelines, nil
+}
+
+// parseSelector converts a config.Selector, the NameRegex is compiled
+func parseSelector(sel config.Selector) (selector, error) {
+	parsed := selector{
+		group:         sel.Group,
+		version:       sel.Version,
+		kind:          sel.Kind,
+		labelSelector: sel.LabelSelector,
+		fieldSelector: sel.FieldSelector,
+		names:         sel.Names,
+		annotations:   sel.Annotations,
+		includeKeys:   sel.IncludeKeys,
+		excludeKeys:   sel.ExcludeKeys,
+	}
+	var err error
+	if parsed.labels, err = labels.Parse(sel.LabelSelector); err != nil {
+		return selector{}, fmt.Errorf("selector %s: %v", sel, err)
+	}
+	if sel.NameRegex != "" {
+		if parsed.nameRegex, err = regexp.Compile(sel.NameRegex); err != nil {
+			return selector{}, fmt.Errorf("selector %s: %v", sel, err)
+		}
+	}
+	return parsed, nil
+}
+
+// run watches the sources of the pipeline and writes its outputs until ctx is cancelled.
+// The first render waits for the initial list of all selectors, in the once mode run returns
+// its error. Errors of later renders are logged only.
+func (p *pipeline) run(ctx context.Context, informers *sharedInformers, resyncInterval time.Duration) error {
+	log.Infof("Pipeline %s started", p.conf.Name)
+	if conf := p.conf; conf.Template != "" || conf.Merge != "" {
+		restoreCtx, cancel := detach(ctx, p.grace)
+		p.restoreLastGood(restoreCtx)
+		cancel()
+	}
+
+	var subscribed []cache.SharedIndexInformer
+	for _, sel := range p.selectors {
+		informer, err := p.subscribe(ctx, informers, sel)
+		if err != nil {
+			log.Errorf("Pipeline %s: %v", p.conf.Name, err)
+			return err
+		}
+		subscribed = append(subscribed, informer)
+	}
+	synced := subscribed
+	if p.namespaces != nil && p.namespaces.selector != "" {
+		informer, err := informers.subscribeNamespaces(p.namespaces.selector, p.nsChanged)
+		if err != nil {
+			log.Errorf("Pipeline %s: %v", p.conf.Name, err)
+			return err
+		}
+		p.namespaces.informer = informer
+		synced = append(synced, informer)
+	}
+	if !p.sync(ctx, synced) {
+		return ctx.Err()
+	}
+	p.checkRestored()
+	err := p.render(ctx)
+	if p.once {
+		log.Infof("Pipeline %s finished", p.conf.Name)
+		return err
+	}
+	if err != nil {
+		log.Warnf("Pipeline %s: %v", p.conf.Name, err)
+	}
+
+	resync := time.NewTicker(resyncInterval)
+	defer resync.Stop()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	changes := &batch{window: p.conf.DebounceWindow, maxWait: p.conf.DebounceMaxWait}
+	var debounce <-chan time.Time // fires when the batch is complete
+	changed := func(n int) {
+		if n > 0 {
+			debounce = time.After(changes.add(n, time.Now()))
+		}
+	}
+	for {
+		sidecarHealth.beat(p.conf.Name)
+		select {
+		case <-ctx.Done():
+			log.Infof("Pipeline %s stopped", p.conf.Name)
+			return nil
+		case <-heartbeat.C:
+		case <-p.nsChanged:
+			changed(p.refilter(subscribed))
+		case e := <-p.events:
+			if p.apply(e) {
+				changed(1)
+			}
+		case <-resync.C:
+			n := 0
+			for _, e := range reconcile(informers, p.namespace, p.namespaces, p.selectors, p.eMap) {
+				if p.apply(e) {
+					n++
+				}
+			}
+			changed(n)
+		case <-debounce:
+			pending := changes.take()
+			log.Debugf("Pipeline %s: render batch of %d changes", p.conf.Name, pending)
+			sidecarBatchSize.WithLabelValues(p.conf.Name).Observe(float64(pending))
+			debounce = nil
+			if err := p.render(ctx); err != nil {
+				log.Warnf("Pipeline %s: %v", p.conf.Name, err)
+			}
+		}
+	}
+}
+
+// maxSubscribeBackoff is the longest wait between two subscriptions of a selector
+const maxSubscribeBackoff = 5 * time.Minute
+
+// subscribe subscribes sel, a failure (e.g. a kind whose CRD is not installed yet)
+// is retried with a doubling backoff until ctx is cancelled. The once mode does not retry.
+func (p *pipeline) subscribe(ctx context.Context, informers *sharedInformers, sel selector) (cache.SharedIndexInformer, error) {
+	backoff := time.Second
+	for {
+		informer, err := informers.subscribe(p.namespace, sel, p.events)
+		if err == nil || p.once {
+			return informer, err
+		}
+		log.Warnf("Pipeline %s: %v, retry in %s", p.conf.Name, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if backoff *= 2; backoff > maxSubscribeBackoff {
+			backoff = maxSubscribeBackoff
+		}
+	}
+}
+
+// sync waits for the initial list of all informers and takes the objects of the informers
+// of p.selectors (same order, first in informers) as sources, their "added" events are
+// delivered later and skipped by apply. False if ctx was cancelled.
+func (p *pipeline) sync(ctx context.Context, informers []cache.SharedIndexInformer) bool {
+	var synced []cache.InformerSynced
+	for _, informer := range informers {
+		synced = append(synced, informer.HasSynced)
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		log.Infof("Pipeline %s stopped before initial sync", p.conf.Name)
+		return false
+	}
+	for i, sel := range p.selectors {
+		for _, obj := range informers[i].GetStore().List() {
+			if e, ok := sel.toEvent(obj, "added"); ok {
+				p.apply(e)
+			}
+		}
+	}
+	log.Infof("Pipeline %s synced %d sources", p.conf.Name, len(p.eMap))
+	return true
+}
+
+// apply records event in eMap with decoded entries, false if the source did not change
+// or only its status annotations did. A source of a namespace that is not allowed is deleted.
+func (p *pipeline) apply(event Event) bool {
+	log.Debugln("Received ", p.conf.Name, event.cmid, event.action)
+	if !p.namespaces.allowed(event.namespace) {
+		prev, present := p.eMap[event.cmid]
+		if !present || prev.action == "deleted" {
+			return false
+		}
+		event = prev
+		event.action = "deleted"
+	}
+	if event.action == "added" {
+		prev, present := p.eMap[event.cmid]
+		if present && prev.action != "deleted" && prev.resourceVersion == event.resourceVersion {
+			return false
+		}
+	}
+	if event.action != "deleted" {
+		event = p.decode(event)
+		if prev, present := p.eMap[event.cmid]; present && prev.action != "deleted" && statusOnlyChange(prev, event) {
+			// our own status annotations, keep the new resourceVersion without a render
+			event.action = prev.action
+			p.eMap[event.cmid] = event
+			return false
+		}
+	}
+	p.eMap[event.cmid] = event
+	p.changes[event.cmid] = event.action
+	return true
+}
+
+// render validates all sources and writes the outputs of the pipeline.
+// The error tells why some source or output did not make it. A shutdown
+// requested by ctx lets the validation, write and reload in flight finish
+// within the ShutdownGracePeriod.
+func (p *pipeline) render(ctx context.Context) error {
+	start := time.Now()
+	renderCtx, cancel := detach(ctx, p.grace)
+	defer cancel()
+	err := p.renderOutputs(renderCtx)
+	p.changes = make(map[string]string)
+	sidecarRenderDuration.WithLabelValues(p.conf.Name).Observe(time.Since(start).Seconds())
+	sidecarSources.WithLabelValues(p.conf.Name).Set(float64(len(p.eMap)))
+	if err == nil {
+		sidecarLastSuccess.WithLabelValues(p.conf.Name, "render").SetToCurrentTime()
+	}
+	return err
+}
+
+// renderOutputs is render without metrics
+func (p *pipeline) renderOutputs(ctx context.Context) error {
+	conf := p.conf
+	if conf.Template == "" && conf.Merge == "" {
+		env := p.hookEnv("")
+		if err := p.runHooks(ctx, conf.PreWriteCommands, env); err != nil {
+			return err
+		}
+		var rejected, failed error
+		if conf.WriteMode == config.WriteModeSymlink {
+			rejected, failed = p.writeDirectories(ctx)
+		} else {
+			rejected, failed = p.writeFiles(ctx)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := p.runHooks(ctx, conf.PostWriteCommands, env); err != nil {
+			return firstError(failed, err)
+		}
+		if !p.reload(ctx) {
+			failed = firstError(failed, fmt.Errorf("reload failed"))
+		}
+		if failed == nil {
+			// invalid sources are skipped, the outputs of the others are in place
+			sidecarHealth.rendered(conf.Name)
+		}
+		return firstError(failed, rejected)
+	}
+
+	tmpOut, valid := p.validOutput(ctx)
+	if ctx.Err() != nil {
+		// validation was interrupted, the output may be incomplete
+		log.Infof("Shutdown during validation, output of %s not written", conf.Name)
+		return ctx.Err()
+	}
+	if !valid {
+		log.Errorf("Pipeline %s: no valid output, nothing written", conf.Name)
+		return fmt.Errorf("no valid output")
+	}
+	if p.lastOut != tmpOut {
+		env := p.hookEnv("")
+		if err := p.runHooks(ctx, conf.PreWriteCommands, env); err != nil {
+			return err
+		}
+		if err := p.writeOutput(tmpOut, p.hasSecretSources()); err != nil {
+			// not written, the same output is tried again by the next render
+			return err
+		}
+		p.lastOut = tmpOut
+		if err := p.runHooks(ctx, conf.PostWriteCommands, env); err != nil {
+			p.rollback(ctx)
+			return err
+		}
+		if !p.reload(ctx) {
+			p.rollback(ctx)
+			return fmt.Errorf("reload failed")
+		}
+		p.saveLastGood(tmpOut)
+	}
+	sidecarHealth.rendered(conf.Name)
+	if len(p.excluded) > 0 {
+		return fmt.Errorf("%d sources excluded by validation", len(p.excluded))
+	}
+	return nil
+}
+
+// defaultShutdownGrace is how long a render in flight may go on after shutdown was
+// requested, below the default terminationGracePeriodSeconds (30s) of a pod
+const defaultShutdownGrace = 20 * time.Second
+
+// detach returns a context that is not cancelled together with parent, it ends
+// grace after parent is done or when cancel is called.
+func detach(parent context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-parent.Done():
+		case <-ctx.Done():
+			return
+		}
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			log.Warnf("Render not finished %s after shutdown, aborted", grace)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// hasSecretSources is true if a Secret contributes to the Template/Merge output
+func (p *pipeline) hasSecretSources() bool {
+	for cmid, e := range p.eMap {
+		if _, excluded := p.excluded[cmid]; !excluded && e.action != "deleted" && e.kind == "Secret" {
+			return true
+		}
+	}
+	return false
+}
+
+// reload calls the URLRealoads and sends the SignalReloads, in the once mode there is nothing to reload yet
+func (p *pipeline) reload(ctx context.Context) bool {
+	if p.once {
+		log.Debugf("Pipeline %s: reloads skipped in once mode", p.conf.Name)
+		return true
+	}
+	urlOK := urlReloads(ctx, p.conf)
+	signalOK := signalReloads(p.conf)
+	return urlOK && signalOK
+}
+
+// writeOutput writes out of the Template/Merge mode to ToFileName, ToSecretName and ToConfigMapName,
+// the error is the first failed output. The file gets SecretFileMode if out contains data of Secrets.
+func (p *pipeline) writeOutput(out string, secret bool) error {
+	conf := p.conf
+	tmpDir := conf.ToDirectory
+	fileName := conf.ToFileName
+	var failed error
+	if conf.WriteMode == config.WriteModeSymlink {
+		payload := map[string]payloadFile{fileName: {data: []byte(out), perm: conf.Perm(secret)}}
+		if err := writePayload(tmpDir, payload); err != nil {
+			log.Errorf("Write to %s failed: %v", tmpDir, err)
+			failed = err
+		}
+		observeWrite(conf.Name, "directory", failed)
+	} else {
+		createDir(tmpDir)
+		failed = writeToFile(tmpDir+fileName, []byte(out), conf.Perm(secret))
+		observeWrite(conf.Name, "file", failed)
+	}
+	log.Infof("Changed write to File %s", tmpDir+fileName)
+
+	namespace := getNamespace(conf.ToNamespace)
+
+	stringData := map[string]string{
+		conf.ToFileName: out,
+	}
+	if conf.ToSecretName != "" {
+		log.Infof("Changed write to Secret %s/%s", namespace, conf.ToSecretName)
+		err := writeToSecret(p.clientset, namespace, conf.ToSecretName, stringData)
+		observeWrite(conf.Name, "secret", err)
+		failed = firstError(failed, err)
+	}
+	if conf.ToConfigMapName != "" {
+		log.Infof("Changed write to ConfigMap %s/%s", namespace, conf.ToConfigMapName)
+		err := writeToConfigMap(p.clientset, namespace, conf.ToConfigMapName, stringData)
+		observeWrite(conf.Name, "configmap", err)
+		failed = firstError(failed, err)
+	}
+	return failed
+}
+
+// targetPath returns the directory (rendered ToDirectory) and the path within it
+// for the entry ent of e. The path is the data key unless the source overrides it
+// by the TargetDirAnnotation (subdirectory) or TargetNameAnnotation (file name
+// template) annotations.
+func (p *pipeline) targetPath(e Event, ent Entry) (string, string, error) {
+	in := map[string]interface{}{
+		"namespace":   e.namespace,
+		"name":        e.name,
+		"labels":      e.labels,
+		"annotations": e.annotations,
+	}
+	dir, err := template.Init().Execute(p.conf.ToDirectory, in)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: ToDirectory: %v", e.cmid, err)
+	}
+	if dir == "" {
+		return "", "", fmt.Errorf("%s: empty ToDirectory", e.cmid)
+	}
+
+	name := ent.name
+	if nameTmpl := e.annotations[p.conf.TargetNameAnnotation]; nameTmpl != "" {
+		in["key"] = ent.name
+		if name, err = template.Init().Execute(nameTmpl, in); err != nil {
+			return "", "", fmt.Errorf("%s key %s: annotation %s: %v", e.cmid, ent.name, p.conf.TargetNameAnnotation, err)
+		}
+		if name == "" {
+			return "", "", fmt.Errorf("%s key %s: annotation %s renders an empty name", e.cmid, ent.name, p.conf.TargetNameAnnotation)
+		}
+	}
+	if subDir, ok := e.annotations[p.conf.TargetDirAnnotation]; ok {
+		if path.Clean(subDir) == "." {
+			return "", "", fmt.Errorf("%s: empty annotation %s", e.cmid, p.conf.TargetDirAnnotation)
+		}
+		name = path.Join(subDir, name)
+	}
+	if err := checkPayloadPath(name); err != nil {
+		return "", "", fmt.Errorf("%s key %s: %v", e.cmid, ent.name, err)
+	}
+	if err := checkSymlinks(dir, name); err != nil {
+		return "", "", fmt.Errorf("%s key %s: %v", e.cmid, ent.name, err)
+	}
+	return dir, name, nil
+}
+
+// writeFiles writes every valid entry of all sources to its own file and removes
+// files of deleted sources and files a source does not produce anymore.
+// rejected is the first invalid entry, failed the first entry that was not written.
+func (p *pipeline) writeFiles(ctx context.Context) (rejected, failed error) {
+	conf := p.conf
+	for cmid, e := range p.eMap {
+		written := make(map[string]bool)
+		var invalid error
+		if e.action != "deleted" {
+			for _, ent := range e.entry {
+				dir, name, err := p.targetPath(e, ent)
+				if err != nil {
+					log.Error(err)
+					if invalid == nil {
+						invalid = err
+					}
+					continue
+				}
+				fileName := dir + name
+				log.Debugf("cmid: '%s' name: '%s' file: '%s' len: %d ", cmid, ent.name, fileName, len(ent.data))
+				err = validData(ctx, conf, p.eMap, cmid, string(ent.data))
+				if err == nil && ctx.Err() == nil {
+					createDir(path.Dir(fileName))
+					err := writeToFile(fileName, ent.data, conf.Perm(e.kind == "Secret"))
+					observeWrite(conf.Name, "file", err)
+					if err == nil {
+						written[fileName] = true
+					} else {
+						failed = firstError(failed, err)
+					}
+				} else if p.files[cmid][fileName] {
+					// keep the previous valid version
+					written[fileName] = true
+				}
+				if err != nil && invalid == nil {
+					invalid = fmt.Errorf("key %s: %v", ent.name, err)
+				}
+			}
+			p.report(ctx, e, invalid)
+			if invalid != nil {
+				rejected = firstError(rejected, fmt.Errorf("%s %v", cmid, invalid))
+			}
+		}
+		for fileName := range p.files[cmid] {
+			if !written[fileName] {
+				log.Infof("Delete file %s (cmid:%s %s)", fileName, cmid, e.action)
+				deleteFile(fileName)
+			}
+		}
+		p.files[cmid] = written
+		if e.action == "deleted" {
+			p.reporter.forget(conf, e)
+			delete(p.eMap, cmid)
+			delete(p.files, cmid)
+		}
+	}
+	return rejected, failed
+}
+
+// writeDirectories writes all valid entries of all sources in the symlink WriteMode,
+// every target directory gets its complete new set of files at once.
+// rejected is the first invalid entry, failed the first directory that was not written.
+func (p *pipeline) writeDirectories(ctx context.Context) (rejected, failed error) {
+	conf := p.conf
+	payloads := make(map[string]map[string]payloadFile)
+	for cmid, e := range p.eMap {
+		if e.action == "deleted" {
+			p.reporter.forget(conf, e)
+			delete(p.eMap, cmid)
+			continue
+		}
+		var invalid error
+		for _, ent := range e.entry {
+			dir, name, err := p.targetPath(e, ent)
+			if err != nil {
+				log.Error(err)
+				if invalid == nil {
+					invalid = err
+				}
+				continue
+			}
+			log.Debugf("cmid: '%s' name: '%s' file: '%s' len: %d ", cmid, ent.name, dir+name, len(ent.data))
+			if payloads[dir] == nil {
+				payloads[dir] = make(map[string]payloadFile)
+			}
+			if err := validData(ctx, conf, p.eMap, cmid, string(ent.data)); err == nil {
+				payloads[dir][name] = payloadFile{data: ent.data, perm: conf.Perm(e.kind == "Secret")}
+			} else if invalid == nil {
+				invalid = fmt.Errorf("key %s: %v", ent.name, err)
+			}
+		}
+		p.report(ctx, e, invalid)
+		if invalid != nil {
+			rejected = firstError(rejected, fmt.Errorf("%s %v", cmid, invalid))
+		}
+	}
+	if ctx.Err() != nil {
+		log.Infof("Shutdown during validation, directories not written")
+		return rejected, ctx.Err()
+	}
+	// directories without sources are emptied
+	for dir := range p.lastDirs {
+		if payloads[dir] == nil {
+			payloads[dir] = make(map[string]payloadFile)
+		}
+	}
+	for dir, payload := range payloads {
+		err := writePayload(dir, payload)
+		observeWrite(conf.Name, "directory", err)
+		if err != nil {
+			log.Errorf("Write to %s failed: %v", dir, err)
+			failed = firstError(failed, err)
+			continue
+		}
+		log.Infof("Changed write to Directory %s (%d files)", dir, len(payload))
+		if len(payload) > 0 {
+			p.lastDirs[dir] = true
+		} else {
+			delete(p.lastDirs, dir)
+		}
+	}
+	return rejected, failed
+}
+
+// report tells the reporter the result of the validation of all entries of e
+func (p *pipeline) report(ctx context.Context, e Event, invalid error) {
+	if ctx.Err() != nil {
+		return
+	}
+	if invalid != nil {
+		p.reporter.invalid(p.conf, e, invalid)
+	} else {
+		p.reporter.valid(p.conf, e)
+	}
+}
+
+// firstError returns err unless there already is an error
+func firstError(failed, err error) error {
+	if failed != nil {
+		return failed
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// validOutput renders the output of all sources and validates it. When the
+// output is invalid the sources breaking it are found by bisection: groups of
+// sources are added to the already accepted ones as long as the result stays
+// valid, a failing group is split in halves until the single offending sources
+// are known. Those are excluded (not forgotten) and all of them are retried once
+// any source is added, changed or deleted: a source may have failed only together
+// with another one. The returned output is valid unless the bool is false.
+func (p *pipeline) validOutput(ctx context.Context) (string, bool) {
+	conf := p.conf
+
+	sources := e2sources(conf, p.eMap)
+	var versions []string
+	for _, source := range sources {
+		versions = append(versions, source.cmid+"@"+source.ResourceVersion)
+	}
+	sort.Strings(versions)
+	if state := strings.Join(versions, ","); state != p.candidates {
+		if len(p.excluded) > 0 {
+			log.Infof("Pipeline %s: sources changed, retrying %d excluded ones", conf.Name, len(p.excluded))
+		}
+		p.excluded = make(map[string]string)
+		p.candidates = state
+	}
+
+	var candidates []string
+	for _, source := range sources {
+		if _, ok := p.excluded[source.cmid]; ok {
+			log.Debugf("Pipeline %s: %s still excluded", conf.Name, source.cmid)
+			continue
+		}
+		candidates = append(candidates, source.cmid)
+	}
+
+	reasons := make(map[string]error)
+	out, err := p.renderValid(ctx, candidates)
+	if err != nil && ctx.Err() == nil {
+		log.Warnf("Pipeline %s: INVALID output of %d sources, looking for the offending ones", conf.Name, len(candidates))
+		var accepted []string
+		var add func(group []string, groupErr error)
+		add = func(group []string, groupErr error) {
+			if len(group) == 0 || ctx.Err() != nil {
+				return
+			}
+			if groupErr == nil {
+				try := append(append([]string{}, accepted...), group...)
+				if _, groupErr = p.renderValid(ctx, try); groupErr == nil {
+					accepted = try
+					return
+				}
+			}
+			if len(group) == 1 {
+				log.Warnf("Pipeline %s: INVALID syntax, %s excluded: %v", conf.Name, group[0], groupErr)
+				p.excluded[group[0]] = p.eMap[group[0]].resourceVersion
+				reasons[group[0]] = groupErr
+				return
+			}
+			half := len(group) / 2
+			add(group[:half], nil)
+			add(group[half:], nil)
+		}
+		add(candidates, err)
+		out, err = p.renderValid(ctx, accepted)
+	}
+
+	for cmid, e := range p.eMap {
+		if e.action == "deleted" {
+			delete(p.eMap, cmid)
+			delete(p.excluded, cmid)
+			sidecarSyntaxOk.DeleteLabelValues(conf.Name, e.namespace, cmid)
+			sidecarSourceExcluded.DeleteLabelValues(conf.Name, e.namespace, cmid)
+			p.reporter.forget(conf, e)
+			continue
+		}
+		if _, ok := p.excluded[cmid]; ok {
+			sidecarSyntaxOk.WithLabelValues(conf.Name, e.namespace, cmid).Set(0)
+			sidecarSourceExcluded.WithLabelValues(conf.Name, e.namespace, cmid).Set(1)
+			if reason, ok := reasons[cmid]; ok {
+				p.reporter.invalid(conf, e, reason)
+			}
+		} else {
+			sidecarSyntaxOk.WithLabelValues(conf.Name, e.namespace, cmid).Set(1)
+			sidecarSourceExcluded.WithLabelValues(conf.Name, e.namespace, cmid).Set(0)
+			if err == nil && ctx.Err() == nil {
+				p.reporter.valid(conf, e)
+			}
+		}
+	}
+	return out, err == nil
+}
+
+// renderValid renders the output of the cmids sources only and validates it
+func (p *pipeline) renderValid(ctx context.Context, cmids []string) (string, error) {
+	sub := make(map[string]Event, len(cmids))
+	for _, cmid := range cmids {
+		sub[cmid] = p.eMap[cmid]
+	}
+	out, err := createOutput(p.conf, sub)
+	if err != nil {
+		return "", err
+	}
+	return out, checkSyntax(ctx, p.conf, out)
+}
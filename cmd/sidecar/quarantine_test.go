@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const mergeJSONConfig = `
+Selectors: ["configmap/app=x"]
+Merge: json
+CheckJSON: true
+ToDirectory: /tmp/out/
+ToFileName: out.json
+`
+
+func excludedCmids(p *pipeline) []string {
+	var cmids []string
+	for cmid := range p.excluded {
+		cmids = append(cmids, cmid)
+	}
+	sort.Strings(cmids)
+	return cmids
+}
+
+func TestValidOutputExcludesOffendingSources(t *testing.T) {
+	tests := []struct {
+		name     string
+		sources  map[string]string // name -> content of a.json
+		excluded []string
+		output   string
+	}{
+		{
+			name:    "all valid",
+			sources: map[string]string{"a": `{"a":1}`, "b": `{"b":2}`},
+			output:  "{\n  \"a\": 1,\n  \"b\": 2\n}",
+		},
+		{
+			name:     "one broken",
+			sources:  map[string]string{"a": `{"a":1}`, "b": `{"b":`, "c": `{"c":3}`},
+			excluded: []string{"ns/b"},
+			output:   "{\n  \"a\": 1,\n  \"c\": 3\n}",
+		},
+		{
+			name:     "two broken",
+			sources:  map[string]string{"a": `[`, "b": `{"b":2}`, "c": `{`, "d": `{"d":4}`},
+			excluded: []string{"ns/a", "ns/c"},
+			output:   "{\n  \"b\": 2,\n  \"d\": 4\n}",
+		},
+		{
+			name:     "conflict excludes the later source",
+			sources:  map[string]string{"a": `{"x":1}`, "b": `{"x":2}`},
+			excluded: []string{"ns/b"},
+			output:   "{\n  \"x\": 1\n}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testPipeline(t, mergeJSONConfig)
+			for name, content := range tt.sources {
+				p.apply(testEvent("ns", name, "1", map[string]string{"a.json": content}))
+			}
+			out, valid := p.validOutput(context.Background())
+			if !valid {
+				t.Fatalf("no valid output")
+			}
+			if out != tt.output {
+				t.Errorf("output %q, want %q", out, tt.output)
+			}
+			if got := excludedCmids(p); !reflect.DeepEqual(got, tt.excluded) {
+				t.Errorf("excluded %v, want %v", got, tt.excluded)
+			}
+		})
+	}
+}
+
+func TestValidOutputRetriesExcludedSources(t *testing.T) {
+	p := testPipeline(t, mergeJSONConfig)
+	p.apply(testEvent("ns", "a", "1", map[string]string{"a.json": `{"x":1}`}))
+	p.apply(testEvent("ns", "b", "1", map[string]string{"a.json": `{"x":2}`}))
+	p.validOutput(context.Background())
+	if got := excludedCmids(p); !reflect.DeepEqual(got, []string{"ns/b"}) {
+		t.Fatalf("excluded %v, want [ns/b]", got)
+	}
+
+	// unchanged sources stay excluded
+	p.validOutput(context.Background())
+	if got := excludedCmids(p); !reflect.DeepEqual(got, []string{"ns/b"}) {
+		t.Fatalf("excluded %v after a render without changes, want [ns/b]", got)
+	}
+
+	// b conflicted only with a, it is retried once a is deleted
+	deleted := p.eMap["ns/a"]
+	deleted.action = "deleted"
+	p.apply(deleted)
+	out, valid := p.validOutput(context.Background())
+	if !valid || out != "{\n  \"x\": 2\n}" {
+		t.Errorf("output %q (valid %v), want b", out, valid)
+	}
+	if got := excludedCmids(p); len(got) != 0 {
+		t.Errorf("excluded %v, want none", got)
+	}
+}
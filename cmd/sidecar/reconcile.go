@@ -0,0 +1,49 @@
+package main
+
+// reconcile lists every selector and compares the result with eMap. It returns
+// synthetic "deleted" events for sources that no longer exist, "modified" events
+// for sources whose resourceVersion drifted and "added" events for sources that
+// were never seen. Sources of namespaces not allowed by namespaces are not listed.
+// Nothing is returned when any of the lists fails, a partial result would look
+// like mass deletion.
+func reconcile(informers *sharedInformers, namespace string, namespaces *namespaceFilter, selectors []selector, eMap map[string]Event) []Event {
+	listed := make(map[string]Event)
+	for _, sel := range selectors {
+		events, err := informers.list(namespace, sel)
+		if err != nil {
+			log.Warnf("Reconcile of %s skipped: %v", sel, err)
+			return nil
+		}
+		for _, e := range events {
+			if namespaces.allowed(e.namespace) {
+				listed[e.cmid] = e
+			}
+		}
+	}
+
+	var out []Event
+	for cmid, known := range eMap {
+		if known.action == "deleted" {
+			continue
+		}
+		current, present := listed[cmid]
+		if !present {
+			log.Infof("Reconcile: %s disappeared", cmid)
+			known.action = "deleted"
+			out = append(out, known)
+			continue
+		}
+		if current.resourceVersion != known.resourceVersion {
+			log.Infof("Reconcile: %s drifted (%s -> %s)", cmid, known.resourceVersion, current.resourceVersion)
+			out = append(out, current)
+		}
+	}
+	for cmid, current := range listed {
+		if known, present := eMap[cmid]; !present || known.action == "deleted" {
+			log.Infof("Reconcile: %s missing", cmid)
+			current.action = "added"
+			out = append(out, current)
+		}
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func versionedConfigMap(namespace, name, resourceVersion string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       namespace,
+			Name:            name,
+			ResourceVersion: resourceVersion,
+			Labels:          map[string]string{"app": "x"},
+		},
+		Data: map[string]string{"a.conf": name},
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	known := func(namespace, name, rv, action string) Event {
+		e := testEvent(namespace, name, rv, map[string]string{"a.conf": name})
+		e.action = action
+		return e
+	}
+	cluster := []runtime.Object{
+		versionedConfigMap("default", "same", "1"),
+		versionedConfigMap("default", "drifted", "2"),
+		versionedConfigMap("default", "new", "1"),
+		versionedConfigMap("default", "readded", "3"),
+		versionedConfigMap("kube-system", "excluded", "1"),
+	}
+	other := versionedConfigMap("default", "other", "1")
+	other.Labels = map[string]string{"app": "y"}
+	cluster = append(cluster, other)
+
+	eMap := map[string]Event{}
+	for _, e := range []Event{
+		known("default", "same", "1", "added"),
+		known("default", "drifted", "1", "modified"),
+		known("default", "gone", "1", "added"),
+		known("default", "readded", "2", "deleted"),
+		known("default", "long-gone", "1", "deleted"),
+		known("kube-system", "excluded", "1", "added"),
+	} {
+		eMap[e.cmid] = e
+	}
+
+	tests := []struct {
+		name    string
+		listErr error
+		want    []string // action cmid@resourceVersion
+	}{
+		{
+			name: "drift",
+			want: []string{
+				"added default/new@1",
+				"added default/readded@3",
+				"deleted default/gone@1",
+				"deleted kube-system/excluded@1",
+				"modified default/drifted@2",
+			},
+		},
+		{name: "failed list", listErr: errors.New("connection refused")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			s := testInformers(stopCh, cluster...)
+			if tt.listErr != nil {
+				s.clientset.(*fake.Clientset).PrependReactor("list", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tt.listErr
+				})
+			}
+			sel, err := parseSelector(config.Selector{Kind: config.KindConfigMap, LabelSelector: "app=x"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			namespaces, err := newNamespaceFilter(config.Pipeline{ExcludeNamespaces: []string{"kube-*"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range reconcile(s, "", namespaces, []selector{sel}, eMap) {
+				got = append(got, e.action+" "+e.cmid+"@"+e.resourceVersion)
+			}
+			sort.Strings(got)
+			if len(got) != len(tt.want) {
+				t.Fatalf("events %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("event %q, want %q", got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
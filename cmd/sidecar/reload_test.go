@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+func generationConfig(t *testing.T, name, template string) *config.Config {
+	t.Helper()
+	c, err := config.LoadConfig(`
+Pipelines:
+- Name: ` + name + `
+  Selectors: ["configmap/app=x"]
+  Template: "` + template + `"
+  ToDirectory: /tmp/out/
+  ToFileName: ` + name + `.conf
+`)
+	if err != nil {
+		t.Fatalf("config %s: %v", name, err)
+	}
+	return c
+}
+
+func TestReloadLoopKeepsGenerationOnInvalidConfig(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reporter := &reporter{invalids: make(map[string]bool)}
+	build := func(c config.Config) ([]*pipeline, error) {
+		return newPipelines(kubernetes.Clientset{}, c, reporter, false)
+	}
+	started := make(chan string, 10)
+	stopped := make(chan string, 10)
+	run := func(ctx context.Context, c config.Config, pipelines []*pipeline) {
+		name := pipelines[0].conf.Name
+		started <- name
+		<-ctx.Done()
+		stopped <- name
+	}
+	expect := func(ch chan string, what, want string) {
+		t.Helper()
+		select {
+		case got := <-ch:
+			if got != want {
+				t.Fatalf("%s %s, want %s", what, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: nothing, want %s", what, want)
+		}
+	}
+
+	first := generationConfig(t, "first", "{{ .x }}")
+	pipelines, err := build(*first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloads := make(chan *config.Config)
+	finished := make(chan struct{})
+	go func() {
+		reloadLoop(ctx, first, pipelines, reloads, build, run)
+		close(finished)
+	}()
+	expect(started, "started", "first")
+
+	// the template does not parse, the pipelines cannot be created
+	reloads <- generationConfig(t, "invalid", "{{ .x")
+	// reloads is unbuffered, the invalid config was handled once the next one is taken
+	reloads <- generationConfig(t, "second", "{{ .y }}")
+	expect(stopped, "stopped", "first")
+	expect(started, "started", "second")
+
+	cancel()
+	expect(stopped, "stopped", "second")
+	<-finished
+	if len(started) != 0 || len(stopped) != 0 {
+		t.Errorf("unexpected generations: %d started, %d stopped", len(started), len(stopped))
+	}
+}
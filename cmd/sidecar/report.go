@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sync"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Annotations set on sources with ReportStatusAnnotations
+const (
+	statusAnnotation    = "k8s-sidecar/status"
+	lastErrorAnnotation = "k8s-sidecar/last-error"
+	maxMessageLength    = 1024
+)
+
+// reporter tells the owners of sources why their config was ignored, by
+// Kubernetes Events on the source (ReportEvents) and by status annotations
+// on the source itself (ReportStatusAnnotations).
+type reporter struct {
+	clientset kubernetes.Clientset
+	recorder  record.EventRecorder
+	mu        sync.Mutex
+	invalids  map[string]bool // pipeline/cmid of sources reported invalid
+}
+
+func newReporter(clientset kubernetes.Clientset) *reporter {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return &reporter{
+		clientset: clientset,
+		recorder:  broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "k8s-sidecar"}),
+		invalids:  make(map[string]bool),
+	}
+}
+
+// invalid reports that e was rejected by the validation of the pipeline
+func (r *reporter) invalid(conf config.Pipeline, e Event, reason error) {
+	message := truncate(reason.Error())
+	r.mu.Lock()
+	r.invalids[conf.Name+"/"+e.cmid] = true
+	r.mu.Unlock()
+
+	if conf.ReportEvents {
+		r.recorder.Eventf(objectReference(e), v1.EventTypeWarning, "InvalidConfig", "Ignored by k8s-sidecar pipeline %s: %s", conf.Name, message)
+	}
+	if conf.ReportStatusAnnotations && (e.annotations[statusAnnotation] != "invalid" || e.annotations[lastErrorAnnotation] != message) {
+		r.annotate(e, map[string]interface{}{
+			statusAnnotation:    "invalid",
+			lastErrorAnnotation: message,
+		})
+	}
+}
+
+// valid reports that e is used by the pipeline, the Event is sent only after an invalid state
+func (r *reporter) valid(conf config.Pipeline, e Event) {
+	key := conf.Name + "/" + e.cmid
+	r.mu.Lock()
+	wasInvalid := r.invalids[key]
+	delete(r.invalids, key)
+	r.mu.Unlock()
+
+	if conf.ReportEvents && wasInvalid {
+		r.recorder.Eventf(objectReference(e), v1.EventTypeNormal, "ValidConfig", "Used by k8s-sidecar pipeline %s", conf.Name)
+	}
+	if conf.ReportStatusAnnotations && e.annotations[statusAnnotation] != "valid" {
+		r.annotate(e, map[string]interface{}{
+			statusAnnotation:    "valid",
+			lastErrorAnnotation: nil,
+		})
+	}
+}
+
+// forget drops the state of a deleted source
+func (r *reporter) forget(conf config.Pipeline, e Event) {
+	r.mu.Lock()
+	delete(r.invalids, conf.Name+"/"+e.cmid)
+	r.mu.Unlock()
+}
+
+// annotate sets annotations (nil removes) on the source by merge patch
+func (r *reporter) annotate(e Event, annotations map[string]interface{}) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	switch e.kind {
+	case "ConfigMap":
+		_, err = r.clientset.CoreV1().ConfigMaps(e.namespace).Patch(e.name, types.MergePatchType, patch)
+	case "Secret":
+		_, err = r.clientset.CoreV1().Secrets(e.namespace).Patch(e.name, types.MergePatchType, patch)
+	default:
+		return
+	}
+	if err != nil {
+		log.Warnf("Status annotations of %s not set: %v", e.cmid, err)
+	}
+}
+
+// statusOnlyChange is true when e differs from prev in the status annotations set
+// by the reporter (and so in resourceVersion) only. Such updates are caused by
+// the sidecar itself and must not render the outputs again.
+func statusOnlyChange(prev, e Event) bool {
+	if prev.object != nil || e.object != nil || prev.kind != e.kind {
+		return false
+	}
+	if !reflect.DeepEqual(prev.labels, e.labels) ||
+		!reflect.DeepEqual(withoutStatus(prev.annotations), withoutStatus(e.annotations)) ||
+		len(prev.entry) != len(e.entry) {
+		return false
+	}
+	data := make(map[string][]byte, len(prev.entry))
+	for _, ent := range prev.entry {
+		data[ent.name] = ent.data
+	}
+	for _, ent := range e.entry {
+		if prevData, ok := data[ent.name]; !ok || !bytes.Equal(prevData, ent.data) {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutStatus returns annotations without the status annotations of the reporter
+func withoutStatus(annotations map[string]string) map[string]string {
+	out := make(map[string]string, len(annotations))
+	for key, value := range annotations {
+		if key != statusAnnotation && key != lastErrorAnnotation {
+			out[key] = value
+		}
+	}
+	return out
+}
+
+func objectReference(e Event) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		APIVersion:      e.apiVersion,
+		Kind:            e.kind,
+		Namespace:       e.namespace,
+		Name:            e.name,
+		UID:             types.UID(e.uid),
+		ResourceVersion: e.resourceVersion,
+	}
+}
+
+func truncate(message string) string {
+	if len(message) > maxMessageLength {
+		return message[:maxMessageLength] + "..."
+	}
+	return message
+}
@@ -18,13 +18,16 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
@@ -32,7 +35,8 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	logrus "github.com/sirupsen/logrus"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/util/homedir"
 	//
 	// Uncomment to load all auth plugins
@@ -62,11 +66,22 @@ var (
 	log        = logrus.WithFields(logrus.Fields{"logger": "main"})
 	configFile = flag.String("config", "/config/sidecar.yaml", "The Snmptrapper configuration file")
 	debug      = flag.Bool("debug", false, "Set Log to debug level and print as text")
+	once       = flag.Bool("once", false, "Render all pipelines once and exit, non-zero if validation failed (init container), same as Mode: once")
+)
 
-	minWatchTimeout = 5 * time.Minute
+// Exit codes of the sidecar process
+const (
+	exitOK     = 0 // stopped by SIGTERM/SIGINT or by a changed config
+	exitError  = 1 // a component the sidecar depends on failed
+	exitFailed = 2 // once mode: some source or output did not pass validation or was not written
+	exitConfig = 3 // the configuration could not be loaded
 )
 
 func main() {
+	os.Exit(run())
+}
+
+func run() int {
 	flag.Parse()
 	if *debug {
 		// The TextFormatter is default, you don't actually have to do this.
@@ -80,13 +95,8 @@ func main() {
 		logrus.SetLevel(logrus.InfoLevel)
 	}
 	log.Infof("Start  Version: %s, Commit %s, Branch %s,BuildDate %s", Version, Commit, Branch, BuildDate)
-	var tmpOut string
-	var lastOut string
 	var kubeconfig *string
 
-	//var mMap = make(map[string]map[string]string)
-	var eMap = make(map[string]Event)
-
 	if home := homedir.HomeDir(); home != "" {
 		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
 	} else {
@@ -99,138 +109,199 @@ func main() {
 	conf, _, err := config.LoadConfigFile(*configFile)
 	if err != nil {
 		log.Errorf("Error loading configuration: %s", err)
-		panic(err)
+		return exitConfig
 	}
-	if conf.CheckSelfConfig {
-		go checkConfig(*configFile)
+
+	// root context, cancelled on SIGTERM/SIGINT or when some component asks to stop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var exitMu sync.Mutex
+	exitCode := exitOK
+	stop := func(code int) {
+		exitMu.Lock()
+		if code > exitCode {
+			exitCode = code
+		}
+		exitMu.Unlock()
+		cancel()
 	}
+	// result reads exitCode, stop may still be called by the http server
+	result := func() int {
+		exitMu.Lock()
+		defer exitMu.Unlock()
+		return exitCode
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Infof("Received %s, shutting down", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
 	//monitoring start
-	http.Handle(conf.PrometheusMetricsURL, promhttp.Handler())
-	port := fmt.Sprintf(":%d", conf.PrometheusMetricsPort)
-	log.Infof("Start http server for Prometheus '0.0.0.0:%d%s'", conf.PrometheusMetricsPort, conf.PrometheusMetricsURL)
-	go http.ListenAndServe(port, nil)
-
-	// create the clientset
-	clientset, err := getClient(*kubeconfig) //kubernetes.NewForConfig(config)
-	if err != nil {
-		panic(err.Error())
+	mux := http.NewServeMux()
+	mux.Handle(conf.PrometheusMetricsURL, promhttp.Handler())
+	mux.Handle(healthzPath, probeHandler(sidecarHealth.live))
+	mux.Handle(readyzPath, probeHandler(sidecarHealth.ready))
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", conf.PrometheusMetricsPort),
+		Handler: mux,
 	}
-	event := make(chan Event)
-	for _, selector := range conf.Selectors {
-		sel := strings.Split(selector, "/")
-		if len(sel) != 2 {
-			panic("wrong config for selector" + selector)
-		}
-		kind := sel[0]
-		labelSelector := sel[1]
-		timeoutSeconds := int64(minWatchTimeout.Seconds() * (rand.Float64() + 1.0))
-		listOptions := metav1.ListOptions{
-			LabelSelector:  labelSelector,
-			Limit:          100,
-			TimeoutSeconds: &timeoutSeconds,
+	log.Infof("Start http server for Prometheus '0.0.0.0:%d%s' (probes %s, %s)", conf.PrometheusMetricsPort, conf.PrometheusMetricsURL, healthzPath, readyzPath)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Http server failed: %v", err)
+			stop(exitError)
 		}
-
-		fromNamespace := ""
-		if conf.FromNamespace != "ALL" {
-			fromNamespace = getNamespace(conf.FromNamespace)
+	}()
+	defer func() {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shutdownCancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Warnf("Http server shutdown: %v", err)
 		}
+	}()
 
-		switch kind {
-		case "configmap":
-			go watchConfigMap(*clientset, fromNamespace, listOptions, event)
-		case "secret":
-			go watchSecret(*clientset, fromNamespace, listOptions, event)
-		default:
-			panic("uknow kind:" + kind)
+	// create the clientset
+	clientset, dynamicClient, err := getClient(*kubeconfig) //kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Errorf("Error creating kubernetes client: %v", err)
+		return exitError
+	}
+	reporter := newReporter(*clientset)
+	runOnce := *once || conf.Mode == config.ModeOnce
+	pipelines, err := newPipelines(*clientset, *conf, reporter, runOnce)
+	if err != nil {
+		log.Errorf("Error loading configuration: %v", err)
+		return exitConfig
+	}
+	if runOnce {
+		if !runSidecar(ctx, *clientset, dynamicClient, *conf, pipelines) {
+			stop(exitFailed)
 		}
-
-		//sleep (download main first-  problem with download additional info before main)
-		time.Sleep(5 * time.Second)
+		return result()
+	}
+	reloads := make(chan *config.Config)
+	if conf.CheckSelfConfig {
+		go checkConfig(ctx, *configFile, reloads)
 	}
+	reloadLoop(ctx, conf, pipelines, reloads,
+		func(conf config.Config) ([]*pipeline, error) {
+			return newPipelines(*clientset, conf, reporter, false)
+		},
+		func(ctx context.Context, conf config.Config, pipelines []*pipeline) {
+			runSidecar(ctx, *clientset, dynamicClient, conf, pipelines)
+		})
+	return result()
+}
+
+// reloadLoop runs the pipelines of conf and replaces them by the pipelines of every
+// config from reloads until ctx is cancelled. Every config generation runs its own
+// watchers, the running generation is kept until build created all pipelines of a
+// new config, an invalid config keeps it running.
+func reloadLoop(ctx context.Context, conf *config.Config, pipelines []*pipeline, reloads <-chan *config.Config,
+	build func(config.Config) ([]*pipeline, error), run func(context.Context, config.Config, []*pipeline)) {
 	for {
-		event, CMok := <-event
-		log.Debugln("Received ", event.cmid, CMok)
-		cmid := event.cmid
-
-		if event.action == "added" {
-			_, present := eMap[cmid]
-			if present {
-				continue
+		genCtx, genCancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func(conf config.Config, pipelines []*pipeline) {
+			run(genCtx, conf, pipelines)
+			close(done)
+		}(*conf, pipelines)
+
+		var newConf *config.Config
+		var next []*pipeline
+		for next == nil {
+			select {
+			case newConf = <-reloads:
+				var err error
+				if next, err = build(*newConf); err != nil {
+					log.Errorf("New config is invalid, keeping the current one: %v", err)
+					sidecarConfigReloadSuccess.Set(0)
+					sidecarConfigReloadFailures.Inc()
+				}
+			case <-ctx.Done():
+				genCancel()
+				<-done
+				return
 			}
 		}
+		sidecarConfigReloadSuccess.Set(1)
+		sidecarConfigReloadTimestamp.SetToCurrentTime()
+		if newConf.PrometheusMetricsPort != conf.PrometheusMetricsPort || newConf.PrometheusMetricsURL != conf.PrometheusMetricsURL {
+			log.Warnf("PrometheusMetricsPort/PrometheusMetricsURL change needs restart of sidecar")
+		}
+		log.Info("Switching to new config")
+		genCancel()
+		<-done
+		conf, pipelines = newConf, next
+	}
+}
 
-		eMap[cmid] = event
-		if conf.Template != "" {
-			tmpOut = validOutput(*conf, cmid, eMap)
-			if lastOut != tmpOut {
-
-				tmpDir := conf.ToDirectory
-				fileName := conf.ToFileName
-				createDir(tmpDir)
-				writeToFile(tmpDir+fileName, tmpOut)
-				log.Infof("Changed write to File %s", tmpDir+fileName)
-
-				namespace := getNamespace(conf.ToNamespace)
-
-				stringData := map[string]string{
-					conf.ToFileName: tmpOut,
-				}
-				if conf.ToSecretName != "" {
-					log.Infof("Changed write to Secret %s/%s", namespace, conf.ToSecretName)
-					writeToSecret(*clientset, namespace, conf.ToSecretName, stringData)
+// runSidecar runs the pipelines of conf until ctx is cancelled, in the once mode until their first render.
+// An event that is being processed is finished first. False if some pipeline failed.
+func runSidecar(ctx context.Context, clientset kubernetes.Clientset, dynamicClient dynamic.Interface, conf config.Config, pipelines []*pipeline) bool {
+	sidecarHealth.configure(conf.HealthStuckTimeout, conf.HealthStartupTimeout, conf.HealthWatchDownTimeout)
+	informers := newSharedInformers(clientset, dynamicClient, ctx.Done())
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+		ok = true
+	)
+	for _, p := range pipelines {
+		p := p
+		sidecarHealth.register(p.conf.Name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.run(ctx, informers, conf.ResyncInterval); err != nil {
+				log.Errorf("Pipeline %s failed: %v", p.conf.Name, err)
+				if ctx.Err() == nil {
+					sidecarHealth.failed(p.conf.Name, err)
 				}
-				if conf.ToConfigMapName != "" {
-					log.Infof("Changed write to ConfigMap %s/%s", namespace, conf.ToSecretName)
-					writeToConfigMap(*clientset, namespace, conf.ToConfigMapName, stringData)
-				}
-				urlReloads(*conf)
-				lastOut = tmpOut
+				mu.Lock()
+				ok = false
+				mu.Unlock()
 			}
+		}()
+	}
+	wg.Wait()
+	for _, p := range pipelines {
+		sidecarHealth.unregister(p.conf.Name)
+	}
+	log.Infof("Sidecar stopped")
+	return ok
+}
 
-		} else {
-
-			dir := conf.ToDirectory
-
-			for cmid := range eMap {
-
-				in := make(map[string]string)
-				in["namespace"] = eMap[cmid].namespace
-				finDir := RunTemplate(dir, in)
-				if finDir == "" {
-					panic("wrong template 'ToDirectory' ")
-				}
-				log.Infof("Rename dir: %s to %s", dir, finDir)
-				for _, ent := range eMap[cmid].entry {
-
-					if eMap[cmid].action == "deleted" {
-						log.Infof("Delete file %s (cmid:%s deleted)", finDir+ent.name, cmid)
-						deleteFile(finDir + ent.name)
-					} else {
-						createDir(finDir)
-						log.Debugf("cmid: '%s' name: '%s' len: %d ", cmid, ent.name, len(ent.data))
-						if validData(*conf, eMap, cmid, ent.data) {
-							writeToFile(finDir+ent.name, ent.data)
-						}
-
-					}
-				}
-				urlReloads(*conf)
-
-				if eMap[cmid].action == "deleted" {
-					delete(eMap, cmid)
-				}
-
+// urlReloads calls all URLRealoads, false if any of them failed after its Retries
+func urlReloads(ctx context.Context, myConfig config.Pipeline) bool {
+	ok := true
+	for _, reload := range myConfig.URLRealoads {
+		backoff := reload.RetryBackoff
+		for attempt := 0; ; attempt++ {
+			code, _, err := MakeHTTPRequest(ctx, reload)
+			observeReload(myConfig.Name, reload.URL, code, err)
+			if err == nil {
+				break
+			}
+			if attempt >= reload.Retries || ctx.Err() != nil {
+				log.Warnf("Reload %s failed: %v", reload.URL, err)
+				ok = false
+				break
 			}
+			log.Infof("Reload %s failed, retry in %s: %v", reload.URL, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+			}
+			backoff *= 2
 		}
-
-	}
-
-}
-func urlReloads(myConfig config.Config) {
-	for _, u := range myConfig.URLRealoads {
-		MakeHTTPRequest(u)
 	}
+	return ok
 }
 func e2map(eMap map[string]Event) map[string]map[string]string {
 
@@ -243,89 +314,114 @@ func e2map(eMap map[string]Event) map[string]map[string]string {
 			}
 
 			for _, ent := range event.entry {
-				if mMap[cmid][ent.name] != ent.data {
-					mMap[cmid][ent.name] = ent.data
+				if mMap[cmid][ent.name] != string(ent.data) {
+					mMap[cmid][ent.name] = string(ent.data)
 				}
 			}
 		}
 	}
 	return mMap
 }
-func validOutput(myConfig config.Config, cmid string, eMap map[string]Event) (tmpOut string) {
-
-	mMap := e2map(eMap)
 
-	tmpOut = createOutput(myConfig, mMap)
-	if checkSyntax(myConfig, tmpOut) {
-		log.Info("Syntax OK ", cmid)
-		sidecarSyntaxOk.WithLabelValues(eMap[cmid].namespace, cmid).Set(1)
-	} else {
-		log.Warn("INVALID syntax: ", cmid)
-		sidecarSyntaxOk.WithLabelValues(eMap[cmid].namespace, cmid).Set(0)
-		delete(eMap, cmid)
-		delete(mMap, cmid)
-		tmpOut = createOutput(myConfig, mMap)
+// e2sources returns the sources of eMap for templates in the order of the pipeline
+func e2sources(myConfig config.Pipeline, eMap map[string]Event) []Source {
+	var sources []Source
+	for _, event := range eMap {
+		if event.action == "deleted" {
+			continue
+		}
+		source := Source{
+			Name:            event.name,
+			Namespace:       event.namespace,
+			Kind:            event.kind,
+			Labels:          event.labels,
+			Annotations:     event.annotations,
+			ResourceVersion: event.resourceVersion,
+			Priority:        sourcePriority(event, myConfig.PriorityKey),
+			Data:            make(map[string]string),
+			Object:          event.object,
+			cmid:            event.cmid,
+		}
+		for _, ent := range event.entry {
+			source.Data[ent.name] = string(ent.data)
+		}
+		sources = append(sources, source)
 	}
-	return
+	sortSources(sources, myConfig.SortBy)
+	return sources
 }
 
-func validData(myConfig config.Config, eMap map[string]Event, cmid string, tmpIn string) (valid bool) {
+// validData checks a single data entry of cmid
+func validData(ctx context.Context, myConfig config.Pipeline, eMap map[string]Event, cmid string, tmpIn string) error {
 
-	if checkSyntax(myConfig, tmpIn) {
-		log.Info("Syntax OK ", cmid)
-		sidecarSyntaxOk.WithLabelValues(eMap[cmid].namespace, cmid).Set(1)
-		return true
+	if err := checkSyntax(ctx, myConfig, tmpIn); err != nil {
+		log.Warnf("INVALID syntax: %s: %v", cmid, err)
+		sidecarSyntaxOk.WithLabelValues(myConfig.Name, eMap[cmid].namespace, cmid).Set(0)
+		return err
 	}
-	log.Warn("INVALID syntax: ", cmid)
-	sidecarSyntaxOk.WithLabelValues(eMap[cmid].namespace, cmid).Set(0)
-	return false
+	log.Info("Syntax OK ", cmid)
+	sidecarSyntaxOk.WithLabelValues(myConfig.Name, eMap[cmid].namespace, cmid).Set(1)
+	return nil
 
 }
 
-func checkSyntax(myConfig config.Config, tmpOut string) bool {
+// checkSyntax returns the reason why tmpOut is not valid, nil for valid one
+func checkSyntax(ctx context.Context, myConfig config.Pipeline, tmpOut string) error {
 
 	if myConfig.CheckYaml {
 		log.Debug("checkSyntax - CheckYaml")
-		val := checkYaml(tmpOut)
-		if !val {
+		if err := observeValidation(myConfig.Name, "yaml", func() error { return checkYaml(tmpOut) }); err != nil {
 			log.Debug(tmpOut)
-			return false
+			return err
 		}
 	}
 
 	if myConfig.CheckJSON {
 		log.Debug("checkSyntax - CheckJSON")
-		val := checkJSON(tmpOut)
-		if !val {
+		if err := observeValidation(myConfig.Name, "json", func() error { return checkJSON(tmpOut) }); err != nil {
 			log.Debug(tmpOut)
-			return false
+			return err
 		}
 	}
 
 	if myConfig.CheckCommand != "" {
 		log.Debug("checkSyntax - CheckCommand")
-		val := false
-		f := myConfig.TmpDirectory + myConfig.ToFileName
-		writeToFile(f, tmpOut)
-		exitCode := RunCommand(myConfig.CheckCommand)
-		deleteFile(f)
-		for _, code := range myConfig.CheckCommandOKExitCode {
-			log.Debugf("Test exit codes compare %d (CheckCommandOKExitCode) vs %d (exitCode)", code, exitCode)
-			if code == exitCode {
-				val = true
-			}
-		}
-		if !val {
-			return false
-		}
+		return observeValidation(myConfig.Name, "command", func() error {
+			return checkCommand(ctx, myConfig, tmpOut)
+		})
 	}
 
-	return true
+	return nil
+}
+
+// checkCommand writes tmpOut to TmpDirectory+ToFileName and runs CheckCommand on it,
+// the file is readable by the owner only as tmpOut may contain data of Secrets
+func checkCommand(ctx context.Context, myConfig config.Pipeline, tmpOut string) error {
+	f := myConfig.TmpDirectory + myConfig.ToFileName
+	if err := writeToFile(f, []byte(tmpOut), 0600); err != nil {
+		return err
+	}
+	exitCode, output := RunCommand(ctx, myConfig.CheckCommand)
+	deleteFile(f)
+	for _, code := range myConfig.CheckCommandOKExitCode {
+		log.Debugf("Test exit codes compare %d (CheckCommandOKExitCode) vs %d (exitCode)", code, exitCode)
+		if code == exitCode {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s exited with %d: %s", myConfig.CheckCommand, exitCode, strings.TrimSpace(output))
 }
 
-func createOutput(myConfig config.Config, data interface{}) string {
+// createOutput renders Template, the data are map[cmid]map[key]data (namespace/name of
+// source -> data key -> content), functions of sourceFuncs iterate sources in SortBy order.
+// With Merge the sources are merged into one document instead, conflicts are errors.
+func createOutput(myConfig config.Pipeline, eMap map[string]Event) (string, error) {
+	if myConfig.Merge != "" {
+		return mergeOutput(myConfig, e2sources(myConfig, eMap))
+	}
 	tmpl := myConfig.Template
-	tmplOut := RunTemplate(tmpl, data)
+	funcs := sourceFuncs(e2sources(myConfig, eMap))
+	tmplOut := runTemplate(tmpl, e2map(eMap), funcs)
 	if myConfig.RemoveComment {
 		tmplOut = removeComments(tmplOut)
 	}
@@ -333,7 +429,7 @@ func createOutput(myConfig config.Config, data interface{}) string {
 		tmplOut = removeEmptyLines(tmplOut)
 	}
 
-	return tmplOut
+	return tmplOut, nil
 }
 func createDir(dirname string) {
 	_ = os.MkdirAll(dirname, os.ModePerm)
@@ -341,7 +437,15 @@ func createDir(dirname string) {
 
 //RunTemplate translate template string to string + trimSpace
 func RunTemplate(text string, data interface{}) string {
+	return runTemplate(text, data, nil)
+}
+
+// runTemplate is RunTemplate with additional template functions
+func runTemplate(text string, data interface{}, funcs template.FuncMap) string {
 	tmpl := template.Init()
+	if funcs != nil {
+		tmpl = tmpl.Funcs(funcs)
+	}
 
 	value, err := tmpl.Execute(text, data)
 	if err != nil {
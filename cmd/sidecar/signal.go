@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+)
+
+// procDir is where the processes of the (shared) process namespace are listed
+const procDir = "/proc"
+
+// signalReloads sends all SignalReloads, false if any of them failed
+func signalReloads(myConfig config.Pipeline) bool {
+	ok := true
+	for _, reload := range myConfig.SignalReloads {
+		err := sendSignal(reload)
+		observeSignal(myConfig.Name, reload.Target(), err)
+		if err != nil {
+			log.Warnf("Reload %s by %s failed: %v", reload.Target(), reload.Signal, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+func sendSignal(reload config.SignalReload) error {
+	var pids []int
+	if reload.PidFile != "" {
+		content, err := ioutil.ReadFile(reload.PidFile)
+		if err != nil {
+			return err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			return fmt.Errorf("wrong pid in %s: %v", reload.PidFile, err)
+		}
+		pids = []int{pid}
+	} else {
+		var err error
+		if pids, err = findProcesses(reload.Process); err != nil {
+			return err
+		}
+		if len(pids) == 0 {
+			return fmt.Errorf("no process %s, is shareProcessNamespace enabled?", reload.Process)
+		}
+	}
+	for _, pid := range pids {
+		log.Infof("Send %s to %d (%s)", reload.Signal, pid, reload.Target())
+		if err := syscall.Kill(pid, reload.SignalNumber()); err != nil {
+			return fmt.Errorf("pid %d: %v", pid, err)
+		}
+	}
+	return nil
+}
+
+// findProcesses returns the pids of the processes named name, by comm or the
+// base name of the executable. Processes whose parent has the same name are
+// skipped, so only the master of master/worker servers (nginx, haproxy) is signalled.
+func findProcesses(name string) ([]int, error) {
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	matching := make(map[int]int) // pid -> parent pid
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		comm, ppid, err := readStat(pid)
+		if err != nil {
+			continue // the process is gone
+		}
+		if comm == name || processExecutable(pid) == name {
+			matching[pid] = ppid
+		}
+	}
+	var pids []int
+	for pid, ppid := range matching {
+		if _, ok := matching[ppid]; !ok {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// readStat returns comm and the parent pid of pid from /proc/<pid>/stat
+func readStat(pid int) (string, int, error) {
+	content, err := ioutil.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return "", 0, err
+	}
+	// pid (comm) state ppid ..., comm may contain spaces and parentheses
+	stat := string(content)
+	start, end := strings.IndexByte(stat, '('), strings.LastIndexByte(stat, ')')
+	if start < 0 || end < start {
+		return "", 0, fmt.Errorf("wrong stat of %d", pid)
+	}
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 2 {
+		return "", 0, fmt.Errorf("wrong stat of %d", pid)
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	return stat[start+1 : end], ppid, err
+}
+
+// processExecutable returns the base name of the first argument of pid
+func processExecutable(pid int) string {
+	cmdline, err := ioutil.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "cmdline"))
+	if err != nil || len(cmdline) == 0 {
+		return ""
+	}
+	return filepath.Base(strings.SplitN(string(cmdline), "\x00", 2)[0])
+}
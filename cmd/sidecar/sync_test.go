@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+const syncConfig = `
+Selectors: ["configmap/app=x"]
+ToDirectory: /tmp/out/
+`
+
+func testConfigMap(name, resourceVersion string, data map[string]string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            name,
+			ResourceVersion: resourceVersion,
+			Labels:          map[string]string{"app": "x"},
+		},
+		Data: data,
+	}
+}
+
+// runInformer runs an informer over a fake ListWatch returning items until ctx is done
+func runInformer(ctx context.Context, items ...v1.ConfigMap) cache.SharedIndexInformer {
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return &v1.ConfigMapList{ListMeta: metav1.ListMeta{ResourceVersion: "10"}, Items: items}, nil
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return watch.NewFake(), nil
+		},
+	}
+	informer := cache.NewSharedIndexInformer(lw, &v1.ConfigMap{}, 0, cache.Indexers{})
+	go informer.Run(ctx.Done())
+	return informer
+}
+
+func TestSync(t *testing.T) {
+	p := testPipeline(t, syncConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	informer := runInformer(ctx,
+		*testConfigMap("a", "1", map[string]string{"a.conf": "a"}),
+		*testConfigMap("b", "2", map[string]string{"b.conf": "b"}),
+	)
+	if !p.sync(ctx, []cache.SharedIndexInformer{informer}) {
+		t.Fatal("sync returned false")
+	}
+	if len(p.eMap) != 2 || len(p.changes) != 2 {
+		t.Fatalf("synced %d sources with %d changes, want 2", len(p.eMap), len(p.changes))
+	}
+	// the informer delivers the "added" events of the initial list later
+	for _, cm := range informer.GetStore().List() {
+		e, _ := p.selectors[0].toEvent(cm, "added")
+		if p.apply(e) {
+			t.Errorf("%s: repeated added event applied", e.cmid)
+		}
+	}
+}
+
+func TestSyncCancelled(t *testing.T) {
+	p := testPipeline(t, syncConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// never synced, the informer does not run
+	informer := cache.NewSharedIndexInformer(&cache.ListWatch{}, &v1.ConfigMap{}, time.Minute, cache.Indexers{})
+	if p.sync(ctx, []cache.SharedIndexInformer{informer}) {
+		t.Error("sync of a cancelled context returned true")
+	}
+}
+
+func TestApply(t *testing.T) {
+	data := map[string]string{"a.conf": "a"}
+	status := testEvent("default", "a", "2", data)
+	status.annotations = map[string]string{statusAnnotation: "ok"}
+	deleted := testEvent("default", "a", "1", data)
+	deleted.action = "deleted"
+	tests := []struct {
+		name    string
+		events  []Event
+		applied []bool
+		action  string // of the source afterwards
+		rv      string
+	}{
+		{
+			name:    "added",
+			events:  []Event{testEvent("default", "a", "1", data)},
+			applied: []bool{true},
+			action:  "added",
+			rv:      "1",
+		},
+		{
+			name:    "repeated added",
+			events:  []Event{testEvent("default", "a", "1", data), testEvent("default", "a", "1", data)},
+			applied: []bool{true, false},
+			action:  "added",
+			rv:      "1",
+		},
+		{
+			name:    "added with a new resourceVersion",
+			events:  []Event{testEvent("default", "a", "1", data), testEvent("default", "a", "2", map[string]string{"a.conf": "b"})},
+			applied: []bool{true, true},
+			action:  "added",
+			rv:      "2",
+		},
+		{
+			name:    "status annotations only",
+			events:  []Event{testEvent("default", "a", "1", data), status},
+			applied: []bool{true, false},
+			action:  "added",
+			rv:      "2",
+		},
+		{
+			name:    "added after deleted",
+			events:  []Event{testEvent("default", "a", "1", data), deleted, testEvent("default", "a", "1", data)},
+			applied: []bool{true, true, true},
+			action:  "added",
+			rv:      "1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testPipeline(t, syncConfig)
+			for i, e := range tt.events {
+				if applied := p.apply(e); applied != tt.applied[i] {
+					t.Errorf("event %d: applied %v, want %v", i, applied, tt.applied[i])
+				}
+			}
+			e := p.eMap["default/a"]
+			if e.action != tt.action || e.resourceVersion != tt.rv {
+				t.Errorf("source %s@%s, want %s@%s", e.action, e.resourceVersion, tt.action, tt.rv)
+			}
+		})
+	}
+}
+
+func TestApplyNamespaceNotAllowed(t *testing.T) {
+	p := testPipeline(t, syncConfig+"ExcludeNamespaces: [\"kube-*\"]\n")
+	if p.apply(testEvent("kube-system", "a", "1", map[string]string{"a.conf": "a"})) {
+		t.Error("source of an excluded namespace applied")
+	}
+	if len(p.eMap) != 0 {
+		t.Errorf("eMap has %d sources, want none", len(p.eMap))
+	}
+}
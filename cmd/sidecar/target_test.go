@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTargetPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempDir("", "outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub", filepath.Join(dir, "inside")); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		targetDir  = "k8s-sidecar/target-dir"
+		targetName = "k8s-sidecar/target-name"
+	)
+	tests := []struct {
+		name        string
+		key         string
+		annotations map[string]string
+		want        string // path within ToDirectory, "" for an error
+	}{
+		{name: "data key", key: "a.conf", want: "a.conf"},
+		{name: "name template", key: "a.conf", annotations: map[string]string{targetName: "{{.namespace}}-{{.key}}"}, want: "default-a.conf"},
+		{name: "subdirectory", key: "a.conf", annotations: map[string]string{targetDir: "team/x"}, want: "team/x/a.conf"},
+		{name: "symlink within ToDirectory", key: "a.conf", annotations: map[string]string{targetDir: "inside"}, want: "inside/a.conf"},
+		{name: "parent in the name", key: "a.conf", annotations: map[string]string{targetName: "../a.conf"}},
+		{name: "parent in the subdirectory", key: "a.conf", annotations: map[string]string{targetDir: "../up"}},
+		{name: "parent after cleaning", key: "a.conf", annotations: map[string]string{targetDir: "a/../../up"}},
+		{name: "absolute name", key: "a.conf", annotations: map[string]string{targetName: "/etc/passwd"}},
+		{name: "absolute subdirectory", key: "a.conf", annotations: map[string]string{targetDir: "/etc"}},
+		{name: "..data", key: "..data"},
+		{name: "empty name", key: "a.conf", annotations: map[string]string{targetName: "{{if false}}x{{end}}"}},
+		{name: "empty subdirectory", key: "a.conf", annotations: map[string]string{targetDir: "."}},
+		{name: "symlink leaving ToDirectory", key: "a.conf", annotations: map[string]string{targetDir: "escape"}},
+		{name: "symlink leaving ToDirectory deeper", key: "a.conf", annotations: map[string]string{targetDir: "escape/x/y"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testPipeline(t, syncConfig)
+			p.conf.ToDirectory = dir + "/"
+			e := testEvent("default", "a", "1", nil)
+			e.annotations = tt.annotations
+			gotDir, got, err := p.targetPath(e, Entry{name: tt.key})
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("path %s accepted", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotDir != dir+"/" || got != tt.want {
+				t.Errorf("path %s%s, want %s/%s", gotDir, got, dir, tt.want)
+			}
+		})
+	}
+}
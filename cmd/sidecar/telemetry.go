@@ -1,6 +1,11 @@
 package main
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 var (
 	sidecarSyntaxOk = prometheus.NewGaugeVec(
@@ -8,11 +13,191 @@ var (
 			Name: "sidecar_syntax_ok",
 			Help: "Sidecar Syntax OK.",
 		},
-		[]string{"namespace", "config"},
+		[]string{"pipeline", "namespace", "config"},
+	)
+	sidecarSourceExcluded = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sidecar_source_excluded",
+			Help: "Source is excluded from the output because it breaks validation.",
+		},
+		[]string{"pipeline", "namespace", "config"},
+	)
+	sidecarRollbacks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sidecar_rollbacks_total",
+			Help: "Number of rollbacks to the last known good output after a failed reload.",
+		},
+		[]string{"pipeline"},
+	)
+	sidecarBatchSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "sidecar_batch_size",
+			Help:    "Number of source changes rendered, validated and reloaded together.",
+			Buckets: []float64{1, 2, 5, 10, 20, 50, 100, 200},
+		},
+		[]string{"pipeline"},
+	)
+	sidecarWatchEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sidecar_watch_events_total",
+			Help: "Number of events received from the watches.",
+		},
+		[]string{"kind", "action", "selector"},
+	)
+	sidecarWatchRestarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sidecar_watch_restarts_total",
+			Help: "Number of list and watch calls, a watch is restarted by a new call.",
+		},
+		[]string{"selector"},
+	)
+	sidecarWatchErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sidecar_watch_errors_total",
+			Help: "Number of failed list and watch calls.",
+		},
+		[]string{"selector"},
+	)
+	sidecarSources = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sidecar_sources",
+			Help: "Number of sources tracked by the pipeline.",
+		},
+		[]string{"pipeline"},
+	)
+	sidecarRenderDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "sidecar_render_duration_seconds",
+			Help: "Duration of the render, validate, write and reload cycle.",
+		},
+		[]string{"pipeline"},
+	)
+	sidecarValidationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "sidecar_validation_duration_seconds",
+			Help: "Duration of the validation by validator (yaml, json, command).",
+		},
+		[]string{"pipeline", "validator"},
+	)
+	sidecarValidations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sidecar_validations_total",
+			Help: "Number of validations by validator and result (valid, invalid).",
+		},
+		[]string{"pipeline", "validator", "result"},
+	)
+	sidecarWrites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sidecar_writes_total",
+			Help: "Number of writes by target (file, directory, secret, configmap) and result (ok, error).",
+		},
+		[]string{"pipeline", "target", "result"},
+	)
+	sidecarReloadRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sidecar_reload_requests_total",
+			Help: "Number of URLRealoads requests by status code, \"error\" when the request failed.",
+		},
+		[]string{"pipeline", "url", "code"},
+	)
+	sidecarSignalReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sidecar_signal_reloads_total",
+			Help: "Number of SignalReloads by target process and result (ok, error).",
+		},
+		[]string{"pipeline", "target", "result"},
+	)
+	sidecarLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sidecar_last_success_timestamp_seconds",
+			Help: "Timestamp of the last successful operation (render, write, reload).",
+		},
+		[]string{"pipeline", "operation"},
+	)
+	sidecarConfigReloadSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sidecar_config_last_reload_successful",
+			Help: "Whether the last sidecar config reload attempt was successful.",
+		},
+	)
+	sidecarConfigReloadFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sidecar_config_reload_failures_total",
+			Help: "Number of rejected sidecar config reloads.",
+		},
+	)
+	sidecarConfigReloadTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sidecar_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful sidecar config reload.",
+		},
 	)
 )
 
 func init() {
 	prometheus.MustRegister(sidecarSyntaxOk)
+	prometheus.MustRegister(sidecarSourceExcluded)
+	prometheus.MustRegister(sidecarRollbacks)
+	prometheus.MustRegister(sidecarBatchSize)
+	prometheus.MustRegister(sidecarWatchEvents)
+	prometheus.MustRegister(sidecarWatchRestarts)
+	prometheus.MustRegister(sidecarWatchErrors)
+	prometheus.MustRegister(sidecarSources)
+	prometheus.MustRegister(sidecarRenderDuration)
+	prometheus.MustRegister(sidecarValidationDuration)
+	prometheus.MustRegister(sidecarValidations)
+	prometheus.MustRegister(sidecarWrites)
+	prometheus.MustRegister(sidecarReloadRequests)
+	prometheus.MustRegister(sidecarSignalReloads)
+	prometheus.MustRegister(sidecarLastSuccess)
+	prometheus.MustRegister(sidecarConfigReloadSuccess)
+	prometheus.MustRegister(sidecarConfigReloadFailures)
+	prometheus.MustRegister(sidecarConfigReloadTimestamp)
+	sidecarConfigReloadSuccess.Set(1)
 	//sidecarSyntaxOk.WithLabelValues("namespace","config").Set(1)
 }
+
+// observeWrite counts a write of pipeline to target
+func observeWrite(pipeline, target string, err error) {
+	if err != nil {
+		sidecarWrites.WithLabelValues(pipeline, target, "error").Inc()
+		return
+	}
+	sidecarWrites.WithLabelValues(pipeline, target, "ok").Inc()
+	sidecarLastSuccess.WithLabelValues(pipeline, "write").SetToCurrentTime()
+}
+
+// observeReload counts a reload request of pipeline, code is 0 when the request failed
+func observeReload(pipeline, url string, code int, err error) {
+	label := "error"
+	if code != 0 {
+		label = strconv.Itoa(code)
+	}
+	sidecarReloadRequests.WithLabelValues(pipeline, url, label).Inc()
+	if err == nil {
+		sidecarLastSuccess.WithLabelValues(pipeline, "reload").SetToCurrentTime()
+	}
+}
+
+// observeSignal counts a signal reload of pipeline
+func observeSignal(pipeline, target string, err error) {
+	if err != nil {
+		sidecarSignalReloads.WithLabelValues(pipeline, target, "error").Inc()
+		return
+	}
+	sidecarSignalReloads.WithLabelValues(pipeline, target, "ok").Inc()
+	sidecarLastSuccess.WithLabelValues(pipeline, "reload").SetToCurrentTime()
+}
+
+// observeValidation runs the validator check and records its duration and result
+func observeValidation(pipeline, validator string, check func() error) error {
+	start := time.Now()
+	err := check()
+	sidecarValidationDuration.WithLabelValues(pipeline, validator).Observe(time.Since(start).Seconds())
+	result := "valid"
+	if err != nil {
+		result = "invalid"
+	}
+	sidecarValidations.WithLabelValues(pipeline, validator, result).Inc()
+	return err
+}
@@ -45,6 +45,15 @@ var funcs = template.FuncMap{
 	},
 }
 
+// FuncMap is the map of additional template functions, see Funcs
+type FuncMap = template.FuncMap
+
+// Funcs adds funcMap to the functions of the template, existing ones are overridden.
+func (t *Template) Funcs(funcMap FuncMap) *Template {
+	t.tmpl.Funcs(funcMap)
+	return t
+}
+
 //LoadTemplateFile reads and parses all templates defined in the given file and constructs.Template.
 func LoadTemplateFile(path string) (*Template, error) {
 	log.V(1).Infof("Loading templates from %q", path)
@@ -70,6 +79,16 @@ func Init() *Template {
 	return &Template{tmpl: tmpl}
 }
 
+// Check parses text with the templates and functions of t, nothing is executed.
+func (t *Template) Check(text string) error {
+	tmpl, err := t.tmpl.Clone()
+	if err != nil {
+		return err
+	}
+	_, err = tmpl.New("").Option("missingkey=zero").Parse(text)
+	return err
+}
+
 // Execute parses the provided text (or returns it unchanged if not a Go template), associates it with the templates
 // defined in t.tmpl (so they may be referenced and used) and applies the resulting template to the specified data
 // object, returning the output as a string.
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -11,30 +14,34 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"regexp"
+	"strings"
 	"syscall"
 
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+
 	"gopkg.in/yaml.v2"
 )
 
-func checkYaml(s string) bool {
+func checkYaml(s string) error {
 	var ya interface{}
 	err := yaml.Unmarshal([]byte(s), &ya)
 	if err != nil {
 		log.Warn(err)
-		return false
+		return err
 	}
-	return true
+	return nil
 }
 
-func checkJSON(s string) bool {
+func checkJSON(s string) error {
 	var js interface{}
 	err := json.Unmarshal([]byte(s), &js)
 	if err != nil {
 		log.Warn(err)
-		return false
+		return err
 	}
-	return true
+	return nil
 
 }
 
@@ -66,29 +73,73 @@ func deleteFile(path string) {
 
 	log.Debug("Deleted ", path)
 }
-func writeToFile(filepath, data string) {
+
+// writeToFile replaces filepath atomically, data go to a temporary file in the
+// same directory which is synced and renamed over filepath, readers never see
+// a partially written file. The directory is synced too, so the rename survives
+// a crash. The file gets the permissions perm.
+func writeToFile(filepath string, data []byte, perm os.FileMode) error {
 	log.Debugf("Write to file %s", filepath)
-	f, err := os.Create(filepath)
+	dir, name := path.Split(filepath)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+name+".tmp")
 	if err != nil {
 		log.Error(err)
-		return
+		return err
 	}
-	l, err := f.WriteString(data)
-	if err != nil {
+	if err := writeAndSync(f, data, perm); err != nil {
+		log.Error(err)
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath); err != nil {
 		log.Error(err)
+		os.Remove(f.Name())
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		log.Warnf("Sync of %s failed: %v", dir, err)
+	}
+	log.Debugf("%d bytes written successfully", len(data))
+	return nil
+}
+
+// writeAndSync writes data to f, sets perm, flushes it to disk and closes f
+func writeAndSync(f *os.File, data []byte, perm os.FileMode) error {
+	if _, err := f.Write(data); err != nil {
 		f.Close()
-		return
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
 	}
-	log.Debugf("%d bytes written successfully", l)
+	return f.Close()
 }
 
-// RunCommand param command return exit code
-func RunCommand(command string) (exitCode int) {
+// RunCommand param command return exit code and stderr (stdout if stderr is empty),
+// the command is killed when ctx is cancelled. Exit code is -1 when the command could not run.
+func RunCommand(ctx context.Context, command string) (exitCode int, output string) {
+	return runCommandEnv(ctx, command, nil)
+}
+
+// runCommandEnv is RunCommand with env added to the environment of the sidecar
+func runCommandEnv(ctx context.Context, command string, env []string) (exitCode int, output string) {
 	args, err := parseCommandLine(command)
-	if err != nil {
-		log.Error(err)
+	if err != nil || len(args) == 0 {
+		log.Errorf("Wrong command %q: %v", command, err)
+		return -1, fmt.Sprintf("wrong command %q", command)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
 	}
-	cmd := exec.Command(args[0], args[1:]...)
 	cmdOutput := &bytes.Buffer{}
 	cmd.Stdout = cmdOutput
 	cmdErrOutput := &bytes.Buffer{}
@@ -104,6 +155,9 @@ func RunCommand(command string) (exitCode int) {
 			waitStatus = exitError.Sys().(syscall.WaitStatus)
 			exitCode = waitStatus.ExitStatus()
 			log.Debugf("exitCode: %s\n", []byte(fmt.Sprintf("%d", waitStatus.ExitStatus())))
+		} else {
+			log.Error(err)
+			return -1, err.Error()
 		}
 	} else {
 		// Success
@@ -116,11 +170,11 @@ func RunCommand(command string) (exitCode int) {
 	if errO != "" {
 		log.Infof("StdOut: %v", string(cmdOutput.Bytes()))
 		log.Infof("ErrOut: %v", errO)
-		return
+		return exitCode, errO
 	}
 
 	log.Debugf("StdOut: %v", string(cmdOutput.Bytes()))
-	return
+	return exitCode, string(cmdOutput.Bytes())
 }
 
 func parseCommandLine(command string) ([]string, error) {
@@ -205,21 +259,100 @@ func hashFileMd5(filePath string) (string, error) {
 
 }
 
-//MakeHTTPRequest make HTTP request to url
-func MakeHTTPRequest(url string) string {
-	log.Infoln("Call HTTP:", url)
-	resp, err := http.Get(url)
+// maxLoggedBody is how much of a response body is logged, maxResponseBody how much is read
+const (
+	maxLoggedBody   = 512
+	maxResponseBody = 1 << 20
+)
+
+// MakeHTTPRequest make the HTTP request of reload, returns status code (0 without response) and body,
+// status codes other than ExpectedStatusCodes (default >= 400) are errors
+func MakeHTTPRequest(ctx context.Context, reload config.URLReload) (int, string, error) {
+	log.Infoln("Call HTTP:", reload.Method, reload.URL)
+	client, err := reloadClient(reload)
 	if err != nil {
-		log.Warnln(err)
-		return ""
+		return 0, "", err
+	}
+	if client.Transport != nil {
+		// the transport is made for this request, keep no connection of it open
+		defer client.CloseIdleConnections()
 	}
+	req, err := http.NewRequest(reload.Method, reload.URL, strings.NewReader(reload.Body))
+	if err != nil {
+		return 0, "", err
+	}
+	req = req.WithContext(ctx)
+	for name, value := range reload.Headers {
+		req.Header.Set(name, value)
+	}
+	if reload.BasicAuth != nil {
+		password, err := ioutil.ReadFile(reload.BasicAuth.PasswordFile)
+		if err != nil {
+			return 0, "", err
+		}
+		req.SetBasicAuth(reload.BasicAuth.Username, strings.TrimSpace(string(password)))
+	}
+	if reload.BearerTokenFile != "" {
+		token, err := ioutil.ReadFile(reload.BearerTokenFile)
+		if err != nil {
+			return 0, "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
 	if err != nil {
-		log.Warnln(err)
-		return ""
+		return resp.StatusCode, "", err
 	}
 
-	log.Infoln(string(body))
-	return string(body)
+	logged := string(body)
+	if len(logged) > maxLoggedBody {
+		logged = logged[:maxLoggedBody] + "..."
+	}
+	log.Debugf("%s returned %s: %s", reload.URL, resp.Status, logged)
+	if !expectedStatus(reload, resp.StatusCode) {
+		return resp.StatusCode, string(body), fmt.Errorf("%s returned %s", reload.URL, resp.Status)
+	}
+	return resp.StatusCode, string(body), nil
+}
+
+// reloadClient returns the HTTP client with Timeout and TLS settings of reload
+func reloadClient(reload config.URLReload) (*http.Client, error) {
+	client := &http.Client{Timeout: reload.Timeout}
+	if reload.CAFile == "" && !reload.InsecureSkipVerify {
+		return client, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: reload.InsecureSkipVerify}
+	if reload.CAFile != "" {
+		ca, err := ioutil.ReadFile(reload.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate in CAFile %s", reload.CAFile)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client.Transport = transport
+	return client, nil
+}
+
+func expectedStatus(reload config.URLReload, code int) bool {
+	if len(reload.ExpectedStatusCodes) == 0 {
+		return code < 400
+	}
+	for _, expected := range reload.ExpectedStatusCodes {
+		if code == expected {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+)
+
+func TestExpectedStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected []int
+		code     int
+		want     bool
+	}{
+		{name: "default ok", code: 200, want: true},
+		{name: "default redirect", code: 302, want: true},
+		{name: "default client error", code: 404, want: false},
+		{name: "default server error", code: 503, want: false},
+		{name: "listed", expected: []int{200, 204}, code: 204, want: true},
+		{name: "not listed", expected: []int{200, 204}, code: 202, want: false},
+		{name: "listed error", expected: []int{200, 404}, code: 404, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reload := config.URLReload{URL: "http://localhost", ExpectedStatusCodes: tt.expected}
+			if got := expectedStatus(reload, tt.code); got != tt.want {
+				t.Errorf("expectedStatus(%v, %d) = %v, want %v", tt.expected, tt.code, got, tt.want)
+			}
+		})
+	}
+}
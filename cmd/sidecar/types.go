@@ -1,15 +1,82 @@
 package main
 
+import (
+	"regexp"
+
+	"github.com/sysincz/k8s-sidecar/cmd/sidecar/config"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
 //Event data from secret/configmap
 type Event struct {
-	entry     []Entry
-	action    string
-	cmid      string
-	namespace string
+	entry           []Entry
+	action          string
+	cmid            string
+	kind            string
+	namespace       string
+	name            string
+	uid             string
+	labels          map[string]string
+	annotations     map[string]string
+	resourceVersion string
+	apiVersion      string
+	object          map[string]interface{} // whole object of kinds other than ConfigMap/Secret
 }
 
 //Entry single entry from configmap/secret (data/strintgData)
 type Entry struct {
 	name string
-	data string
+	data []byte
+}
+
+// selector parsed from config Selectors, kind is "configmap"/"secret" or the Kind of any other resource.
+// Only fieldSelector is given to the API server, labels and the other filters
+// are applied to the events of the informer shared by all selectors of the kind.
+type selector struct {
+	group         string
+	version       string
+	kind          string
+	labelSelector string
+	labels        labels.Selector // parsed labelSelector, nil matches everything
+	fieldSelector string
+	names         []string
+	nameRegex     *regexp.Regexp
+	annotations   map[string]string
+	includeKeys   []string
+	excludeKeys   []string
+}
+
+// resource returns kind for ConfigMaps/Secrets, group/version/Kind otherwise
+func (s selector) resource() string {
+	if s.kind == config.KindConfigMap || s.kind == config.KindSecret {
+		return s.kind
+	}
+	if s.group == "" {
+		return s.version + "/" + s.kind
+	}
+	return s.group + "/" + s.version + "/" + s.kind
+}
+
+func (s selector) String() string {
+	if s.fieldSelector != "" {
+		return s.resource() + "/" + s.labelSelector + "/" + s.fieldSelector
+	}
+	return s.resource() + "/" + s.labelSelector
+}
+
+// Source is a ConfigMap/Secret as seen by templates (function "sources")
+type Source struct {
+	Name            string
+	Namespace       string
+	Kind            string
+	Labels          map[string]string
+	Annotations     map[string]string
+	ResourceVersion string
+	Priority        int
+	Data            map[string]string
+	// Object is the whole object (spec, ...) of kinds other than ConfigMap/Secret
+	Object map[string]interface{}
+
+	cmid string // key of the source in eMap
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	dataDirName    = "..data"
+	newDataDirName = "..data_tmp"
+)
+
+// payloadFile is the content and permissions of a file of a payload
+type payloadFile struct {
+	data []byte
+	perm os.FileMode
+}
+
+// writePayload writes payload (file name -> file) into dir the way kubelet
+// updates ConfigMap volumes. Files go to a new timestamped directory, the
+// "..data" symlink is swapped to it with one rename and every file in dir is a
+// symlink through "..data", so readers see either the old or the new set of
+// files, never a mix. Files of the previous payload that are missing in the
+// new one are removed.
+func writePayload(dir string, payload map[string]payloadFile) error {
+	createDir(dir)
+	tsDir, err := ioutil.TempDir(dir, time.Now().UTC().Format("..2006_01_02_15_04_05."))
+	if err != nil {
+		return err
+	}
+	tsDirName := filepath.Base(tsDir)
+	for name, file := range payload {
+		if err := checkPayloadPath(name); err != nil {
+			os.RemoveAll(tsDir)
+			return err
+		}
+		fileName := filepath.Join(tsDir, name)
+		createDir(filepath.Dir(fileName))
+		f, err := os.Create(fileName)
+		if err != nil {
+			os.RemoveAll(tsDir)
+			return err
+		}
+		if err := writeAndSync(f, file.data, file.perm); err != nil {
+			os.RemoveAll(tsDir)
+			return err
+		}
+	}
+	if err := os.Chmod(tsDir, 0755); err != nil {
+		os.RemoveAll(tsDir)
+		return err
+	}
+
+	dataDir := filepath.Join(dir, dataDirName)
+	oldTsDirName, err := os.Readlink(dataDir)
+	if err != nil && !os.IsNotExist(err) {
+		os.RemoveAll(tsDir)
+		return err
+	}
+	oldPaths := map[string]bool{}
+	if oldTsDirName != "" {
+		oldPaths = topLevelPaths(filepath.Join(dir, oldTsDirName))
+	}
+
+	newDataDir := filepath.Join(dir, newDataDirName)
+	os.Remove(newDataDir)
+	if err := os.Symlink(tsDirName, newDataDir); err != nil {
+		os.RemoveAll(tsDir)
+		return err
+	}
+	if err := os.Rename(newDataDir, dataDir); err != nil {
+		os.Remove(newDataDir)
+		os.RemoveAll(tsDir)
+		return err
+	}
+
+	newPaths := topLevelPaths(tsDir)
+	for name := range newPaths {
+		link := filepath.Join(dir, name)
+		target := filepath.Join(dataDirName, name)
+		if current, err := os.Readlink(link); err == nil && current == target {
+			continue
+		}
+		// missing, or a file left by the rename WriteMode that would hide the payload
+		if err := replaceWithSymlink(target, link); err != nil {
+			log.Error(err)
+		}
+	}
+	if err := syncDir(dir); err != nil {
+		log.Warnf("Sync of %s failed: %v", dir, err)
+	}
+	for name := range oldPaths {
+		if !newPaths[name] {
+			deleteFile(filepath.Join(dir, name))
+		}
+	}
+	if oldTsDirName != "" && oldTsDirName != tsDirName {
+		if err := os.RemoveAll(filepath.Join(dir, oldTsDirName)); err != nil {
+			log.Error(err)
+		}
+	}
+	log.Debugf("Payload of %d files written to %s (%s)", len(payload), dir, tsDirName)
+	return nil
+}
+
+// replaceWithSymlink makes link a symlink to target, whatever link was before
+func replaceWithSymlink(target, link string) error {
+	tmp := filepath.Join(filepath.Dir(link), "..link_"+filepath.Base(link))
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(link); err == nil && fi.IsDir() {
+		if err := os.RemoveAll(link); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// syncDir flushes the entries of dir (renames, new symlinks) to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// topLevelPaths returns names of the entries of dir
+func topLevelPaths(dir string) map[string]bool {
+	paths := map[string]bool{}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return paths
+	}
+	for _, f := range files {
+		paths[f.Name()] = true
+	}
+	return paths
+}
+
+// checkPayloadPath rejects names that would escape the payload directory or clash with "..data"
+func checkPayloadPath(name string) error {
+	if name == "" || filepath.IsAbs(name) {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if strings.HasPrefix(part, "..") {
+			return fmt.Errorf("invalid file name %q", name)
+		}
+	}
+	return nil
+}
+
+// checkSymlinks rejects a name whose parent directories resolve outside of dir
+// through symlinks already in dir, e.g. a subdirectory linked to /etc. The file
+// itself is replaced by a rename and never followed.
+func checkSymlinks(dir, name string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		// nothing there yet, the directories are created by the write
+		return nil
+	}
+	current := root
+	for _, part := range strings.Split(filepath.Dir(filepath.FromSlash(name)), string(filepath.Separator)) {
+		if part == "." {
+			break
+		}
+		current = filepath.Join(current, part)
+		resolved, err := filepath.EvalSymlinks(current)
+		if err != nil {
+			return nil
+		}
+		if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("file name %q leaves %s through a symlink", name, dir)
+		}
+		current = resolved
+	}
+	return nil
+}
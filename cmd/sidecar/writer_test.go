@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// readPayload returns the files of dir read through their "..data" symlinks
+func readPayload(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name[0] == '.' {
+			continue
+		}
+		target, err := os.Readlink(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s is not a symlink: %v", name, err)
+			continue
+		}
+		if target != filepath.Join(dataDirName, name) {
+			t.Errorf("%s links to %s", name, target)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[name] = string(data)
+	}
+	return files
+}
+
+// timestampDirs returns the timestamped payload directories of dir
+func timestampDirs(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, "..20*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+func TestWritePayload(t *testing.T) {
+	tests := []struct {
+		name     string
+		stale    map[string]string // regular files in dir before the first payload
+		payloads []map[string]string
+		want     map[string]string
+	}{
+		{
+			name:     "first payload",
+			payloads: []map[string]string{{"a.conf": "a", "b.conf": "b"}},
+			want:     map[string]string{"a.conf": "a", "b.conf": "b"},
+		},
+		{
+			name:     "update and removal",
+			payloads: []map[string]string{{"a.conf": "a", "b.conf": "b"}, {"a.conf": "a2", "c.conf": "c"}},
+			want:     map[string]string{"a.conf": "a2", "c.conf": "c"},
+		},
+		{
+			name:     "stale regular file replaced",
+			stale:    map[string]string{"a.conf": "old"},
+			payloads: []map[string]string{{"a.conf": "a"}},
+			want:     map[string]string{"a.conf": "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "payload")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for name, data := range tt.stale {
+				if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, files := range tt.payloads {
+				payload := map[string]payloadFile{}
+				for name, data := range files {
+					payload[name] = payloadFile{data: []byte(data), perm: 0640}
+				}
+				if err := writePayload(dir, payload); err != nil {
+					t.Fatalf("writePayload: %v", err)
+				}
+			}
+			if got := readPayload(t, dir); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("files %v, want %v", got, tt.want)
+			}
+			if dirs := timestampDirs(t, dir); len(dirs) != 1 {
+				t.Errorf("payload directories %v, want one", dirs)
+			}
+			for name := range tt.want {
+				fi, err := os.Stat(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Mode().Perm() != 0640 {
+					t.Errorf("%s mode %o, want 0640", name, fi.Mode().Perm())
+				}
+			}
+		})
+	}
+}
+
+func TestCheckPayloadPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "a.conf"},
+		{name: "sub/a.conf"},
+		{name: "", wantErr: true},
+		{name: "/etc/passwd", wantErr: true},
+		{name: "../a.conf", wantErr: true},
+		{name: "..data", wantErr: true},
+		{name: "sub/../../a.conf", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkPayloadPath(tt.name); (err != nil) != tt.wantErr {
+				t.Errorf("checkPayloadPath(%q) = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+}